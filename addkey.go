@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// runAddKey generates a new key in slot, on a YubiKey already configured with
+// -setup, for example a key that doesn't need a touch for automated jobs.
+func runAddKey(yk *piv.YubiKey, slot piv.Slot, key piv.Key) {
+	defer yk.Close()
+
+	if _, err := yk.Certificate(slot); err == nil {
+		fatal(exitAlreadySetUp, "‼️  Slot", slot, "already has a key. Pick an empty slot with -slot.")
+	} else if !errors.Is(err, piv.ErrNotFound) {
+		log.Fatalf("Failed to access slot %s: %v", slot, err)
+	}
+
+	mk := managementKeyFromMetadata(yk)
+
+	fmt.Println("🧪 Generating the key...")
+	pub, err := yk.GenerateKey(mk, slot, key)
+	if err != nil {
+		log.Fatalln("Failed to generate key:", err)
+	}
+	commonName := "SSH key"
+	if key.TouchPolicy == piv.TouchPolicyNever {
+		commonName = "SSH key (NO TOUCH REQUIRED)"
+	}
+	cert, err := selfSignedCertificate(pub, commonName)
+	if err != nil {
+		log.Fatalln("Failed to generate certificate:", err)
+	}
+	if err := yk.SetCertificate(mk, slot, cert); err != nil {
+		log.Fatalln("Failed to store certificate:", err)
+	}
+
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		log.Fatalln("Failed to generate public key:", err)
+	}
+	fmt.Println("✅ Done! A new key was generated in slot", slot)
+	if key.TouchPolicy == piv.TouchPolicyNever {
+		fmt.Println("⚠️  It can be used without touching the YubiKey, as long as it's plugged in.")
+	}
+	if key.PINPolicy == piv.PINPolicyNever {
+		fmt.Println("⚠️  It can be used without the PIN.")
+	}
+	fmt.Println("🔑 Here's its SSH public key:")
+	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
+	if slot != piv.SlotAuthentication {
+		fmt.Println("")
+		fmt.Printf("To offer it from the agent, run it with -slots 9a,%s.\n", slot)
+	}
+}
+
+// parseTouchPolicy parses the -touch-policy flag.
+func parseTouchPolicy(s string) (piv.TouchPolicy, error) {
+	switch s {
+	case "always":
+		return piv.TouchPolicyAlways, nil
+	case "cached":
+		return piv.TouchPolicyCached, nil
+	case "never":
+		return piv.TouchPolicyNever, nil
+	}
+	return 0, fmt.Errorf("unknown touch policy %q, expected always, cached, or never", s)
+}
+
+// parsePINPolicy parses the -pin-policy flag.
+func parsePINPolicy(s string) (piv.PINPolicy, error) {
+	switch s {
+	case "never":
+		return piv.PINPolicyNever, nil
+	case "once":
+		return piv.PINPolicyOnce, nil
+	case "always":
+		return piv.PINPolicyAlways, nil
+	}
+	return 0, fmt.Errorf("unknown PIN policy %q, expected never, once, or always", s)
+}
+
+// parseAlgorithm parses the -algorithm flag. Only algorithms the agent can
+// use for SSH are accepted.
+func parseAlgorithm(s string) (piv.Algorithm, error) {
+	switch s {
+	case "ecdsa-p256":
+		return piv.AlgorithmEC256, nil
+	case "ecdsa-p384":
+		return piv.AlgorithmEC384, nil
+	case "rsa2048":
+		return piv.AlgorithmRSA2048, nil
+	}
+	return 0, fmt.Errorf("unknown algorithm %q, expected ecdsa-p256, ecdsa-p384, or rsa2048", s)
+}
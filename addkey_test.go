@@ -0,0 +1,35 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+func TestParsePINPolicy(t *testing.T) {
+	tests := []struct {
+		s    string
+		want piv.PINPolicy
+	}{
+		{"never", piv.PINPolicyNever},
+		{"once", piv.PINPolicyOnce},
+		{"always", piv.PINPolicyAlways},
+	}
+	for _, tt := range tests {
+		got, err := parsePINPolicy(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("parsePINPolicy(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "Once", "cached", "default"} {
+		if _, err := parsePINPolicy(s); err == nil {
+			t.Errorf("parsePINPolicy(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadAllowedKeys reads the file at path, and returns the set of SHA-256
+// fingerprints it lists. Each line is either a fingerprint, like the ones
+// printed by ssh-keygen -l, or a public key in authorized_keys format. Empty
+// lines and lines starting with # are ignored.
+func loadAllowedKeys(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fp := strings.Fields(line)[0]; strings.HasPrefix(fp, "SHA256:") {
+			allowed[fp] = true
+			continue
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: not a SHA256 fingerprint or public key: %v", path, n, err)
+		}
+		allowed[ssh.FingerprintSHA256(pk)] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%s doesn't list any keys", path)
+	}
+	return allowed, nil
+}
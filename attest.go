@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// attestation is the result of -attest -verify. Its JSON encoding is meant to
+// be consumed by enrollment tooling, so fields should only ever be added.
+type attestation struct {
+	Slot        string `json:"slot"`
+	Serial      uint32 `json:"serial"`
+	Version     string `json:"version"`
+	Formfactor  string `json:"formfactor"`
+	PINPolicy   string `json:"pinPolicy"`
+	TouchPolicy string `json:"touchPolicy"`
+	PublicKey   string `json:"publicKey"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// runAttest prints the attestation certificate for the key in slot, followed
+// by the device attestation certificate that signed it. With verify, it
+// instead checks the chain up to the Yubico PIV root CA, and prints the
+// attested properties of the key.
+func runAttest(yk *piv.YubiKey, slot piv.Slot, verify, asJSON bool) {
+	defer yk.Close()
+
+	intermediate, err := yk.AttestationCertificate()
+	if err != nil {
+		log.Fatalln("Failed to read the device attestation certificate:", err)
+	}
+	cert, err := yk.Attest(slot)
+	if err != nil {
+		log.Fatalf("Failed to attest slot %s: %v", slot, err)
+	}
+
+	if !verify {
+		pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})
+		return
+	}
+
+	a, err := piv.Verify(intermediate, cert)
+	if err != nil {
+		log.Fatalln("❌ Attestation verification failed:", err)
+	}
+	pk, err := ssh.NewPublicKey(cert.PublicKey)
+	if err != nil {
+		log.Fatalln("Failed to process the attested public key:", err)
+	}
+	info := attestation{
+		Slot:        slot.String(),
+		Serial:      a.Serial,
+		Version:     fmt.Sprintf("%d.%d.%d", a.Version.Major, a.Version.Minor, a.Version.Patch),
+		Formfactor:  a.Formfactor.String(),
+		PINPolicy:   pinPolicyName(a.PINPolicy),
+		TouchPolicy: touchPolicyName(a.TouchPolicy),
+		PublicKey:   strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pk)), "\n"),
+		Fingerprint: ssh.FingerprintSHA256(pk),
+	}
+	if asJSON {
+		printJSON(info)
+		return
+	}
+	fmt.Println("✅ The key was generated on a genuine YubiKey, attested up to the Yubico PIV root CA.")
+	fmt.Println("")
+	fmt.Printf("Slot:         %s\n", info.Slot)
+	fmt.Printf("Serial:       %d\n", info.Serial)
+	fmt.Printf("Firmware:     %s\n", info.Version)
+	fmt.Printf("Form factor:  %s\n", info.Formfactor)
+	fmt.Printf("PIN policy:   %s\n", info.PINPolicy)
+	fmt.Printf("Touch policy: %s\n", info.TouchPolicy)
+	fmt.Printf("Fingerprint:  %s\n", info.Fingerprint)
+	fmt.Println(info.PublicKey)
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// client serves a single agent connection, keeping track of the state the
+// client reported on it, and dispatching to the shared Agent.
+type client struct {
+	*Agent
+
+	// id identifies the connection in logs. It's zero for calls that don't
+	// come from a connection, like Agent.Sign.
+	id uint64
+
+	// hostKey is the host key of the server the client is authenticating to,
+	// from the last session-bind@openssh.com extension request.
+	hostKey ssh.PublicKey
+
+	// hostName is the name hostKey is listed under in known_hosts, if any.
+	hostName string
+
+	// peer is the process on the other end of the connection, if known.
+	peer *peerCred
+
+	// policy is the policy of the listener that accepted the connection.
+	policy connPolicy
+
+	// forwarded is set if any session-bind@openssh.com request on this
+	// connection was for agent forwarding, meaning requests come from a
+	// remote host.
+	forwarded bool
+
+	// slot, if not nil, is the only slot listed and used for signatures on
+	// this connection, selected with selectSlotExtension.
+	slot *piv.Slot
+
+	// confirmed is set once the user allows the signature request being
+	// served, so that it's not asked again if it falls back to the Upstream
+	// agent.
+	confirmed bool
+
+	// upstream is the connection to the Upstream agent, dialed the first time
+	// it's needed.
+	upstream     agent.ExtendedAgent
+	upstreamConn net.Conn
+}
+
+var _ agent.ExtendedAgent = &client{}
+
+// errRestricted is returned for the operations restricted connections can't
+// perform.
+var errRestricted = errors.New("operation not allowed on the restricted socket")
+
+// lastClientID is the id of the most recent connection.
+var lastClientID atomic.Uint64
+
+func (c *client) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.SignWithFlags(key, data, 0)
+}
+
+func (c *client) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case "session-bind@openssh.com":
+		if err := c.sessionBind(contents); err != nil {
+			return nil, err
+		}
+		// Let the upstream agent apply its own destination constraints.
+		if ua := c.upstreamAgent(); ua != nil {
+			ua.Extension(extensionType, contents)
+		}
+		return nil, nil
+	case loopCheckExtension:
+		return c.loopCheck(contents)
+	case selectSlotExtension:
+		return nil, c.selectSlot(contents)
+	case rawSignExtension:
+		return c.rawSign(contents)
+	}
+	res, err := c.Agent.Extension(extensionType, contents)
+	// Extensions unknown to this agent could do anything to the upstream
+	// agent, so they are not relayed for restricted connections.
+	if err == agent.ErrExtensionUnsupported && !c.policy.Restricted {
+		if ua := c.upstreamAgent(); ua != nil {
+			return ua.Extension(extensionType, contents)
+		}
+	}
+	return res, err
+}
+
+// sessionBind handles the session-bind@openssh.com extension, which OpenSSH
+// clients use to tell the agent what host they are authenticating to, proven
+// by the host's signature over the session identifier.
+//
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.agent.
+func (c *client) sessionBind(contents []byte) error {
+	var req struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return fmt.Errorf("failed to parse session-bind request: %w", err)
+	}
+	hostKey, err := ssh.ParsePublicKey(req.HostKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse session-bind host key: %w", err)
+	}
+	sig := new(ssh.Signature)
+	if err := ssh.Unmarshal(req.Signature, sig); err != nil {
+		return fmt.Errorf("failed to parse session-bind signature: %w", err)
+	}
+	if err := hostKey.Verify(req.SessionID, sig); err != nil {
+		return fmt.Errorf("invalid session-bind signature: %w", err)
+	}
+	c.hostKey = hostKey
+	c.hostName = knownHostName(hostKey)
+	if req.Forwarding {
+		c.forwarded = true
+	}
+	return nil
+}
+
+// selectSlotExtension makes the connection list and sign only with the key in
+// one slot, for clients that want to choose between the keys of the YubiKey
+// deliberately. The contents are the slot name as an SSH string, like "9c",
+// or an empty string to go back to all slots.
+const selectSlotExtension = "select-slot@filippo.io"
+
+func (c *client) selectSlot(contents []byte) error {
+	var req struct {
+		Slot string
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return fmt.Errorf("failed to parse %s request: %w", selectSlotExtension, err)
+	}
+	if req.Slot == "" {
+		c.slot = nil
+		return nil
+	}
+	slot, err := parseSlot(req.Slot)
+	if err != nil {
+		return err
+	}
+	for _, s := range c.Slots {
+		if s == slot {
+			c.slot = &slot
+			c.logInfo("using only one slot", "connection", c.id, "slot", slot.String())
+
+			return nil
+		}
+	}
+	return fmt.Errorf("slot %s is not one of the -slots", slot)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// cygwinHandshakeTimeout is how long a client has to complete the Cygwin
+// socket handshake.
+const cygwinHandshakeTimeout = 5 * time.Second
+
+// cygwinListener emulates a UNIX socket the way Cygwin and MSYS2 do, so that
+// the ssh bundled with Git for Windows can connect to it. The socket file
+// contains a loopback TCP port and a random cookie, which clients prove they
+// read by sending it first on the TCP connection.
+type cygwinListener struct {
+	net.Listener
+	path   string
+	cookie []byte
+}
+
+// listenCygwin listens on a loopback TCP port and writes a Cygwin socket file
+// pointing to it at path.
+func listenCygwin(path string) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Clients parse the four hex words and send them as little-endian
+	// integers, so that's the order of the cookie bytes on the wire.
+	var words [4]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(cookie[i*4:])
+	}
+	content := fmt.Sprintf("!<socket >%d s %08x-%08x-%08x-%08x\x00",
+		l.Addr().(*net.TCPAddr).Port, words[0], words[1], words[2], words[3])
+	os.Remove(path)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Cygwin only recognizes socket files with the system attribute.
+	p, err := windows.UTF16PtrFromString(path)
+	if err == nil {
+		err = windows.SetFileAttributes(p, windows.FILE_ATTRIBUTE_SYSTEM)
+	}
+	if err != nil {
+		l.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to mark %s as a socket: %w", path, err)
+	}
+	return &cygwinListener{Listener: l, path: path, cookie: cookie}, nil
+}
+
+func (l *cygwinListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := l.handshake(c); err != nil {
+			slog.Warn("rejected Cygwin socket connection", "remote", c.RemoteAddr().String(), "error", err)
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// handshake checks the cookie sent by the client and echoes it back, then
+// exchanges the pid, uid, and gid, which are not checked.
+func (l *cygwinListener) handshake(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(cygwinHandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	cookie := make([]byte, len(l.cookie))
+	if _, err := io.ReadFull(c, cookie); err != nil {
+		return err
+	}
+	if !bytes.Equal(cookie, l.cookie) {
+		return errors.New("wrong cookie")
+	}
+	if _, err := c.Write(cookie); err != nil {
+		return err
+	}
+	creds := make([]byte, 12)
+	if _, err := io.ReadFull(c, creds); err != nil {
+		return err
+	}
+	// Reply with our pid, and the client's uid and gid.
+	binary.LittleEndian.PutUint32(creds, uint32(os.Getpid()))
+	_, err := c.Write(creds)
+	return err
+}
+
+func (l *cygwinListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
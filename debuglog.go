@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// debugConn logs the agent protocol messages read from and written to the
+// connection, with -debug. It logs their type and the public keys involved,
+// but never PINs, passphrases, or signatures.
+type debugConn struct {
+	net.Conn
+	id uint64
+
+	in, out frameBuffer
+
+	// start is when the request being served was received.
+	start time.Time
+}
+
+func (c *debugConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.feed(b[:n], func(req []byte) {
+		c.start = time.Now()
+		slog.Debug("request", "connection", c.id, "request", describeRequest(req))
+	})
+	return n, err
+}
+
+func (c *debugConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.feed(b[:n], func(reply []byte) {
+		slog.Debug("reply", "connection", c.id, "reply", describeReply(reply),
+			"duration", time.Since(c.start).Round(time.Millisecond))
+
+	})
+	return n, err
+}
+
+// frameBuffer splits a byte stream into agent protocol messages, each
+// prefixed by its length as a uint32.
+type frameBuffer struct {
+	buf []byte
+}
+
+func (f *frameBuffer) feed(b []byte, fn func(msg []byte)) {
+	f.buf = append(f.buf, b...)
+	for len(f.buf) >= 4 {
+		l := binary.BigEndian.Uint32(f.buf)
+		if l > maxRequestSize {
+			// Not a stream we can follow, give up on it.
+			f.buf = nil
+			return
+		}
+		if uint32(len(f.buf)-4) < l {
+			return
+		}
+		if l > 0 {
+			fn(f.buf[4 : 4+l])
+		}
+		f.buf = f.buf[4+l:]
+	}
+}
+
+// Message numbers of the agent protocol, from
+// https://datatracker.ietf.org/doc/html/draft-miller-ssh-agent.
+const (
+	agentRequestIdentities   = 11
+	agentIdentitiesAnswer    = 12
+	agentSignRequest         = 13
+	agentSignResponse        = 14
+	agentAddIdentity         = 17
+	agentRemoveIdentity      = 18
+	agentRemoveAllIdentities = 19
+	agentLock                = 22
+	agentUnlock              = 23
+	agentAddIDConstrained    = 25
+	agentExtension           = 27
+	agentExtensionFailure    = 28
+)
+
+func describeRequest(req []byte) string {
+	switch req[0] {
+	case agentRequestIdentities:
+		return "REQUEST_IDENTITIES"
+	case agentSignRequest:
+		var msg struct {
+			KeyBlob []byte
+			Data    []byte
+			Flags   uint32
+		}
+		if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+			return "SIGN_REQUEST (malformed)"
+		}
+		return fmt.Sprintf("SIGN_REQUEST for %s, %d bytes of data, flags %#x",
+			describeKeyBlob(msg.KeyBlob), len(msg.Data), msg.Flags)
+	case agentAddIdentity, agentAddIDConstrained:
+		var msg struct {
+			Type string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+			return "ADD_IDENTITY (malformed)"
+		}
+		return fmt.Sprintf("ADD_IDENTITY of type %s", msg.Type)
+	case agentRemoveIdentity:
+		var msg struct {
+			KeyBlob []byte
+		}
+		if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+			return "REMOVE_IDENTITY (malformed)"
+		}
+		return "REMOVE_IDENTITY for " + describeKeyBlob(msg.KeyBlob)
+	case agentRemoveAllIdentities:
+		return "REMOVE_ALL_IDENTITIES"
+	case agentAddSmartcardKey, agentAddSmartcardKeyConstrained:
+		// The PIN follows the reader name.
+		var msg struct {
+			ReaderID string
+			Rest     []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+			return "ADD_SMARTCARD_KEY (malformed)"
+		}
+		return fmt.Sprintf("ADD_SMARTCARD_KEY for %q", msg.ReaderID)
+	case agentRemoveSmartcardKey:
+		return "REMOVE_SMARTCARD_KEY"
+	case agentLock:
+		return "LOCK"
+	case agentUnlock:
+		return "UNLOCK"
+	case agentExtension:
+		var msg struct {
+			Type string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(req[1:], &msg); err != nil {
+			return "EXTENSION (malformed)"
+		}
+		return fmt.Sprintf("EXTENSION %s, %d bytes of contents", msg.Type, len(msg.Rest))
+	default:
+		return fmt.Sprintf("of unknown type %d, %d bytes", req[0], len(req))
+	}
+}
+
+func describeReply(reply []byte) string {
+	switch reply[0] {
+	case agentFailure:
+		return "FAILURE"
+	case agentSuccess:
+		if len(reply) > 1 {
+			return fmt.Sprintf("SUCCESS, %d bytes", len(reply))
+		}
+		return "SUCCESS"
+	case agentIdentitiesAnswer:
+		if len(reply) < 5 {
+			return "IDENTITIES_ANSWER (malformed)"
+		}
+		return fmt.Sprintf("IDENTITIES_ANSWER with %d key(s)", binary.BigEndian.Uint32(reply[1:5]))
+	case agentSignResponse:
+		return "SIGN_RESPONSE"
+	case agentExtensionFailure:
+		return "EXTENSION_FAILURE"
+	default:
+		return fmt.Sprintf("of type %d, %d bytes", reply[0], len(reply))
+	}
+}
+
+func describeKeyBlob(blob []byte) string {
+	pk, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return "an unparsable key"
+	}
+	return pk.Type() + " key " + ssh.FingerprintSHA256(pk)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dumpState writes a snapshot of the agent state and of the goroutine stacks
+// to a temporary file, to debug an agent that misbehaves without attaching a
+// debugger. It's triggered by SIGUSR1.
+func (a *Agent) dumpState() {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "yubikey-agent %s state dump, %s\n\n", Version, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Active connections: %d\n", a.activeConns.Load())
+	// Don't wait for an operation that might be stuck, which is likely what
+	// is being debugged.
+	if a.mu.TryLock() {
+		a.dumpLocked(&b)
+		a.mu.Unlock()
+	} else {
+		fmt.Fprintln(&b, "Busy: an operation is in progress, maybe waiting for the PIN or a touch.")
+	}
+	fmt.Fprintln(&b, "\nGoroutines:")
+	buf := make([]byte, 1<<20)
+	b.Write(buf[:runtime.Stack(buf, true)])
+
+	f, err := os.CreateTemp("", "yubikey-agent-dump-*.txt")
+	if err != nil {
+		slog.Error("failed to write the state dump", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(b.Bytes()); err != nil {
+		slog.Error("failed to write the state dump", "error", err)
+		return
+	}
+	slog.Info("wrote the state dump", "path", f.Name())
+}
+
+func (a *Agent) dumpLocked(w io.Writer) {
+	if a.yk == nil {
+		fmt.Fprintln(w, "YubiKey: not connected")
+	} else {
+		v := a.yk.Version()
+		fmt.Fprintf(w, "YubiKey: #%d, firmware %d.%d.%d\n", a.serial, v.Major, v.Minor, v.Patch)
+	}
+	if a.retriesKnown {
+		fmt.Fprintf(w, "PIN retries: %d\n", a.retries)
+	} else {
+		fmt.Fprintln(w, "PIN retries: unknown")
+	}
+	fmt.Fprintf(w, "PIN blocked: %v\n", a.pinBlocked)
+	if a.signerCache != nil && a.signerCacheYK == a.yk {
+		for _, s := range a.signerCache {
+			fmt.Fprintf(w, "Key: %s %s\n", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()))
+		}
+	} else {
+		fmt.Fprintln(w, "Keys: not loaded")
+	}
+	fmt.Fprintf(w, "Last connection error: %v\n", a.connectErr)
+	fmt.Fprintf(w, "Last PIN prompt error: %v\n", a.pinErr)
+	fmt.Fprintf(w, "Last signature error: %v\n", a.signErr)
+}
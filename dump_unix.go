@@ -0,0 +1,21 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump relays to c the signal that requests a state dump, SIGUSR1.
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,12 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import "os"
+
+// notifyDump is a no-op, as there is no SIGUSR1 on Windows.
+func notifyDump(c chan<- os.Signal) {}
@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"archive/zip"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// runExport writes a zip file at path with everything about the keys on the
+// YubiKey that is not secret: for each slot, the SSH public key, the stored
+// certificate, and the attestation chain, if the key was generated on the
+// device. It's enough to register the keys again and to verify them later.
+func runExport(yk *piv.YubiKey, path string) {
+	defer yk.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Fatalln("Failed to create the export file:", err)
+	}
+	z := zip.NewWriter(f)
+
+	intermediate, err := yk.AttestationCertificate()
+	if err != nil {
+		log.Println("Failed to read the device attestation certificate, attestations will be missing:", err)
+	}
+	var n int
+	for _, slot := range keySlots() {
+		cert, err := yk.Certificate(slot)
+		if errors.Is(err, piv.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Skipping slot %s: %v", slot, err)
+			continue
+		}
+		name := "slot-" + slot.String()
+		if pk, err := ssh.NewPublicKey(cert.PublicKey); err == nil {
+			writeExportFile(z, name+".pub", ssh.MarshalAuthorizedKey(pk))
+		}
+		writeExportFile(z, name+".crt", pemCertificates(cert))
+		if intermediate != nil {
+			if attestation, err := yk.Attest(slot); err == nil {
+				writeExportFile(z, name+"-attestation.pem", pemCertificates(attestation, intermediate))
+			}
+		}
+		n++
+	}
+
+	if err := z.Close(); err != nil {
+		log.Fatalln("Failed to write the export file:", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalln("Failed to write the export file:", err)
+	}
+	fmt.Printf("Exported %d key(s) to %s.\n", n, path)
+}
+
+func writeExportFile(z *zip.Writer, name string, data []byte) {
+	w, err := z.Create(name)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		log.Fatalln("Failed to write the export file:", err)
+	}
+}
+
+func pemCertificates(certs ...*x509.Certificate) []byte {
+	var out []byte
+	for _, cert := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return out
+}
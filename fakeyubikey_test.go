@@ -0,0 +1,268 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakePIN is the PIN of every fakeDevice.
+const fakePIN = "123456"
+
+// fakeDevice is an in-memory YubiKey with software keys. Like a physical one,
+// it's used through sessions, each opened by open and with its own PIN
+// verification state.
+type fakeDevice struct {
+	mu      sync.Mutex
+	serial  uint32
+	retries int
+	keys    map[piv.Slot]*fakeKey
+
+	// unplugged makes open fail with errNoYubiKey.
+	unplugged bool
+
+	// hideRetries makes Retries fail even if the PIN is not verified.
+	hideRetries bool
+
+	// signHook, if not nil, is called by every signature before it's
+	// produced, like when the YubiKey waits for a touch.
+	signHook func()
+
+	// session is the last one opened.
+	session *fakeYubiKey
+
+	// opens, verifies, and privateKeys count the calls to open, VerifyPIN,
+	// and PrivateKey, and signs the signatures produced.
+	opens, verifies, privateKeys, signs int
+}
+
+type fakeKey struct {
+	priv crypto.Signer
+	cert *x509.Certificate
+}
+
+// newFakeDevice returns a fakeDevice with a new key of each type in keys in the
+// matching slot. Valid types are "p256", "p384", "p521", and "rsa".
+func newFakeDevice(t *testing.T, serial uint32, keys map[piv.Slot]string) *fakeDevice {
+	t.Helper()
+	d := &fakeDevice{serial: serial, retries: 3, keys: make(map[piv.Slot]*fakeKey)}
+	for slot, typ := range keys {
+		var priv crypto.Signer
+		var err error
+		switch typ {
+		case "p256":
+			priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case "p384":
+			priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case "p521":
+			priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		case "rsa":
+			priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		default:
+			t.Fatalf("unknown key type %q", typ)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := selfSignedCertificate(priv.Public(), "fake YubiKey "+slot.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.keys[slot] = &fakeKey{priv: priv, cert: cert}
+	}
+	return d
+}
+
+// publicKey returns the SSH public key in slot.
+func (d *fakeDevice) publicKey(t *testing.T, slot piv.Slot) ssh.PublicKey {
+	t.Helper()
+	pk, err := ssh.NewPublicKey(d.keys[slot].priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// open opens a new session, and can be used as Agent.openYubiKey.
+func (d *fakeDevice) open() (yubiKey, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unplugged {
+		return nil, errNoYubiKey
+	}
+	d.opens++
+	d.session = &fakeYubiKey{d: d}
+	return d.session, nil
+}
+
+// breakSession makes the last session stop responding, like after a suspend,
+// so that the next operation has to reconnect.
+func (d *fakeDevice) breakSession() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.session.broken = true
+}
+
+// fakeYubiKey is a session on a fakeDevice. Its keys have PIN policy "once":
+// the PIN is needed by the first signature of each session.
+type fakeYubiKey struct {
+	d                        *fakeDevice
+	verified, closed, broken bool
+}
+
+var _ yubiKey = &fakeYubiKey{}
+
+var errFakeBroken = errors.New("fake YubiKey: not responding")
+
+// check must be called with y.d.mu held.
+func (y *fakeYubiKey) check() error {
+	if y.closed {
+		return errors.New("fake YubiKey: session closed")
+	}
+	if y.broken {
+		return errFakeBroken
+	}
+	return nil
+}
+
+func (y *fakeYubiKey) AttestationCertificate() (*x509.Certificate, error) {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{}, nil
+}
+
+func (y *fakeYubiKey) Certificate(slot piv.Slot) (*x509.Certificate, error) {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return nil, err
+	}
+	k, ok := y.d.keys[slot]
+	if !ok {
+		return nil, piv.ErrNotFound
+	}
+	return k.cert, nil
+}
+
+func (y *fakeYubiKey) PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error) {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return nil, err
+	}
+	y.d.privateKeys++
+	k, ok := y.d.keys[slot]
+	if !ok {
+		return nil, piv.ErrNotFound
+	}
+	return &fakeSigner{y: y, k: k, auth: auth}, nil
+}
+
+func (y *fakeYubiKey) Serial() (uint32, error) {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return 0, err
+	}
+	return y.d.serial, nil
+}
+
+// Version is older than 5, so that maybeReleaseYK keeps the session open on
+// macOS too.
+func (y *fakeYubiKey) Version() piv.Version {
+	return piv.Version{Major: 4, Minor: 3, Patch: 7}
+}
+
+func (y *fakeYubiKey) Retries() (int, error) {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return 0, err
+	}
+	if y.verified || y.d.hideRetries {
+		return 0, errors.New("fake YubiKey: can't read the retries")
+	}
+	return y.d.retries, nil
+}
+
+func (y *fakeYubiKey) VerifyPIN(pin string) error {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	if err := y.check(); err != nil {
+		return err
+	}
+	y.d.verifies++
+	if y.d.retries == 0 {
+		return piv.AuthErr{Retries: 0}
+	}
+	if pin != fakePIN {
+		y.d.retries--
+		return piv.AuthErr{Retries: y.d.retries}
+	}
+	y.d.retries = 3
+	y.verified = true
+	return nil
+}
+
+func (y *fakeYubiKey) Close() error {
+	y.d.mu.Lock()
+	defer y.d.mu.Unlock()
+	y.closed, y.verified = true, false
+	return nil
+}
+
+// fakeSigner is the crypto.Signer returned by fakeYubiKey.PrivateKey. Like
+// piv-go, it asks auth for the PIN if the session is not verified yet.
+type fakeSigner struct {
+	y    *fakeYubiKey
+	k    *fakeKey
+	auth piv.KeyAuth
+}
+
+func (s *fakeSigner) Public() crypto.PublicKey {
+	return s.k.priv.Public()
+}
+
+func (s *fakeSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.y.d.mu.Lock()
+	verified, err := s.y.verified, s.y.check()
+	s.y.d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		pin, err := s.auth.PINPrompt()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.y.VerifyPIN(pin); err != nil {
+			return nil, err
+		}
+	}
+	if s.y.d.signHook != nil {
+		s.y.d.signHook()
+	}
+	s.y.d.mu.Lock()
+	s.y.d.signs++
+	s.y.d.mu.Unlock()
+	return s.k.priv.Sign(rand, digest, opts)
+}
@@ -1,12 +1,19 @@
 module filippo.io/yubikey-agent
 
-go 1.19
+go 1.21
 
 require (
-	github.com/go-piv/piv-go v1.10.0
+	github.com/Microsoft/go-winio v0.6.0
+	github.com/go-piv/piv-go/v2 v2.3.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/twpayne/go-pinentry-minimal v0.0.0-20220113210447-2a5dc4396c2a
+	github.com/zalando/go-keyring v0.2.2
 	golang.org/x/crypto v0.4.0
+	golang.org/x/sys v0.3.0
 	golang.org/x/term v0.3.0
 )
 
-require golang.org/x/sys v0.3.0 // indirect
+require (
+	github.com/alessio/shellescape v1.4.1 // indirect
+	github.com/danieljoos/wincred v1.1.2 // indirect
+)
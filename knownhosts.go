@@ -0,0 +1,50 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHostName returns the names hostKey is listed under in the user's
+// ~/.ssh/known_hosts, joined by commas, or "" if it's not there. Hashed
+// entries can't be reversed, and are skipped.
+func knownHostName(hostKey ssh.PublicKey) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	rest, err := os.ReadFile(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return ""
+	}
+	want := hostKey.Marshal()
+	var names []string
+	for len(rest) > 0 {
+		var marker string
+		var hosts []string
+		var key ssh.PublicKey
+		marker, hosts, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		if marker != "" || !bytes.Equal(key.Marshal(), want) {
+			continue
+		}
+		for _, h := range hosts {
+			if !strings.HasPrefix(h, "|") {
+				names = append(names, h)
+			}
+		}
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// listedKey is a key as shown by -list and -info. Its JSON encoding is meant
+// to be consumed by scripts, so fields should only ever be added.
+type listedKey struct {
+	Slot        string `json:"slot"`
+	Algorithm   string `json:"algorithm"`
+	PublicKey   string `json:"publicKey"`
+	Fingerprint string `json:"fingerprint"`
+	// TouchPolicy and PINPolicy come from the slot attestation, and are
+	// empty for keys that were imported rather than generated on the YubiKey.
+	TouchPolicy string `json:"touchPolicy,omitempty"`
+	PINPolicy   string `json:"pinPolicy,omitempty"`
+}
+
+type yubiKeyInfo struct {
+	Serial     uint32      `json:"serial"`
+	Version    string      `json:"version"`
+	PINRetries int         `json:"pinRetries"`
+	Keys       []listedKey `json:"keys"`
+}
+
+// listedDevice is a smart card as shown by -list-devices. Serial and Version
+// are empty for cards that can't be opened as a YubiKey.
+type listedDevice struct {
+	Card    string `json:"card"`
+	Serial  uint32 `json:"serial,omitempty"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runListDevices prints all the detected smart cards, and the serial number
+// and firmware version of the YubiKeys among them.
+func runListDevices(asJSON bool) {
+	cards, err := piv.Cards()
+	if err != nil {
+		log.Fatalln("Failed to list smart cards:", err)
+	}
+	devices := []listedDevice{}
+	for _, card := range cards {
+		d := listedDevice{Card: card}
+		if yk, err := piv.Open(card); err != nil {
+			d.Error = err.Error()
+		} else {
+			if d.Serial, err = yk.Serial(); err != nil {
+				d.Error = err.Error()
+			}
+			v := yk.Version()
+			d.Version = fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+			yk.Close()
+		}
+		devices = append(devices, d)
+	}
+	if asJSON {
+		printJSON(devices)
+		return
+	}
+	if len(devices) == 0 {
+		fmt.Println("No smart cards detected.")
+		return
+	}
+	for _, d := range devices {
+		if d.Serial != 0 {
+			fmt.Printf("YubiKey #%d, firmware %s\t%s\n", d.Serial, d.Version, d.Card)
+		} else {
+			fmt.Printf("%s (%s)\n", d.Card, d.Error)
+		}
+	}
+}
+
+// keySlots are all the PIV slots that can hold a key usable for SSH.
+func keySlots() []piv.Slot {
+	slots := []piv.Slot{piv.SlotAuthentication, piv.SlotSignature,
+		piv.SlotKeyManagement, piv.SlotCardAuthentication}
+	for key := uint32(0x82); key <= 0x95; key++ {
+		slot, _ := piv.RetiredKeyManagementSlot(key)
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func runList(yk *piv.YubiKey, info, asJSON bool) {
+	defer yk.Close()
+
+	keys := listKeys(yk)
+	if !info {
+		if asJSON {
+			printJSON(keys)
+			return
+		}
+		printKeys(keys)
+		return
+	}
+
+	serial, err := yk.Serial()
+	if err != nil {
+		log.Fatalln("Failed to read the serial number:", err)
+	}
+	retries, err := yk.Retries()
+	if err != nil {
+		log.Fatalln("Failed to read the PIN retries:", err)
+	}
+	v := yk.Version()
+	yi := yubiKeyInfo{
+		Serial:     serial,
+		Version:    fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch),
+		PINRetries: retries,
+		Keys:       keys,
+	}
+	if asJSON {
+		printJSON(yi)
+		return
+	}
+	fmt.Printf("YubiKey #%d, firmware %s\n", yi.Serial, yi.Version)
+	fmt.Printf("PIN retries remaining: %d\n", yi.PINRetries)
+	fmt.Println("")
+	printKeys(keys)
+}
+
+func listKeys(yk *piv.YubiKey) []listedKey {
+	attestationCert, err := yk.AttestationCertificate()
+	if err != nil {
+		log.Println("Failed to read the attestation certificate, policies will be missing:", err)
+	}
+	keys := []listedKey{}
+	for _, slot := range keySlots() {
+		pk, err := getPublicKey(yk, slot)
+		if errors.Is(err, piv.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Skipping slot %s: %v", slot, err)
+			continue
+		}
+		k := listedKey{
+			Slot:        slot.String(),
+			Algorithm:   keyAlgorithm(pk),
+			PublicKey:   strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pk)), "\n"),
+			Fingerprint: ssh.FingerprintSHA256(pk),
+		}
+		if attestationCert != nil {
+			if cert, err := yk.Attest(slot); err == nil {
+				if a, err := piv.Verify(attestationCert, cert); err == nil {
+					k.PINPolicy = pinPolicyName(a.PINPolicy)
+					k.TouchPolicy = touchPolicyName(a.TouchPolicy)
+				}
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func printKeys(keys []listedKey) {
+	if len(keys) == 0 {
+		fmt.Println("No keys found. Run \"yubikey-agent -setup\" to generate one.")
+		return
+	}
+	for i, k := range keys {
+		if i > 0 {
+			fmt.Println("")
+		}
+		desc := k.Algorithm
+		if k.PINPolicy != "" {
+			desc += fmt.Sprintf(", PIN %s, touch %s", k.PINPolicy, k.TouchPolicy)
+		}
+		fmt.Printf("🔑 Slot %s (%s)\n", k.Slot, desc)
+		fmt.Println(k.PublicKey)
+		fmt.Println(k.Fingerprint)
+	}
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalln("Failed to encode JSON:", err)
+	}
+}
+
+// keyAlgorithm returns the name of the key algorithm as used by ykman.
+func keyAlgorithm(pk ssh.PublicKey) string {
+	switch k := pk.(ssh.CryptoPublicKey).CryptoPublicKey().(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECCP%d", k.Curve.Params().BitSize)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA%d", k.N.BitLen())
+	default:
+		return pk.Type()
+	}
+}
+
+func pinPolicyName(p piv.PINPolicy) string {
+	switch p {
+	case piv.PINPolicyNever:
+		return "never"
+	case piv.PINPolicyOnce:
+		return "once"
+	case piv.PINPolicyAlways:
+		return "always"
+	default:
+		return fmt.Sprintf("unknown (%d)", p)
+	}
+}
+
+func touchPolicyName(p piv.TouchPolicy) string {
+	switch p {
+	case piv.TouchPolicyNever:
+		return "never"
+	case piv.TouchPolicyAlways:
+		return "always"
+	case piv.TouchPolicyCached:
+		return "cached"
+	default:
+		return fmt.Sprintf("unknown (%d)", p)
+	}
+}
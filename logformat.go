@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The agent logs with log/slog. Messages are constant, like "wrong PIN", so
+// that records of the same kind can be grouped, and every value is an
+// attribute. Call sites use these keys where they apply:
+//
+//   - "event", what happened, for the events worth filtering on, like
+//     "signature" or "pin-wrong";
+//   - "connection", the number of the agent connection;
+//   - "serial", the serial number of the YubiKey;
+//   - "slot", the PIV slot, like "9a";
+//   - "fingerprint", the SHA256 fingerprint of the SSH key;
+//   - "error", the error that caused the message.
+//
+// The JSON format records them as fields, while the text format and the
+// targets without fields append them to the message as key=value pairs.
+
+// logLevel is the minimum level of the agent log. -debug lowers it to
+// slog.LevelDebug.
+var logLevel = new(slog.LevelVar)
+
+// newLogHandler returns the handler for -log-format text or json, writing
+// to w, or nil if format is unknown.
+func newLogHandler(format string, w io.Writer) slog.Handler {
+	switch format {
+	case "text":
+		return newTextLogHandler(w, true)
+	case "json":
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel})
+	}
+	return nil
+}
+
+// newTextLogHandler returns a handler that writes each record on its own
+// line, formatted by formatLogLine and prefixed by the time if withTime is
+// set, like the standard logger.
+func newTextLogHandler(w io.Writer, withTime bool) slog.Handler {
+	var mu sync.Mutex
+	return &recordHandler{emit: func(r slog.Record, attrs []slog.Attr) error {
+		line := formatLogLine(r.Message, attrs) + "\n"
+		if withTime {
+			line = r.Time.Format("2006/01/02 15:04:05 ") + line
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := io.WriteString(w, line)
+		return err
+	}}
+}
+
+// formatLogLine returns msg followed by attrs as key=value pairs, quoting the
+// values that are empty or contain spaces, quotes, or equal signs.
+func formatLogLine(msg string, attrs []slog.Attr) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, a := range attrs {
+		v := a.Value.Resolve().String()
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, v)
+	}
+	return b.String()
+}
+
+// recordHandler is a slog.Handler that passes the records at logLevel or
+// above to emit, with their attributes and the ones added by WithAttrs. The
+// agent doesn't use groups, so WithGroup does nothing.
+type recordHandler struct {
+	attrs []slog.Attr
+	emit  func(r slog.Record, attrs []slog.Attr) error
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := slices.Clip(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return h.emit(r, attrs)
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordHandler{attrs: append(slices.Clip(h.attrs), attrs...), emit: h.emit}
+}
+
+func (h *recordHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// logFatal logs msg as an error, with args as its fields, and exits, like
+// log.Fatal does for the commands that don't use the agent log.
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestJSONLog(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	a := newTestAgent(t, d, &pinPrompter{pins: []string{"000000", fakePIN}})
+	logs := captureLog(t, "json")
+	key := d.publicKey(t, piv.SlotAuthentication)
+	c := &client{Agent: a, id: 7}
+	if _, err := c.SignWithFlags(key, []byte("session"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make(map[string]map[string]any)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid JSON record %q: %v", line, err)
+		}
+		if event, ok := r["event"].(string); ok {
+			records[event] = r
+		}
+	}
+	check := func(event string, want map[string]any) {
+		t.Helper()
+		r, ok := records[event]
+		if !ok {
+			t.Errorf("no %q record in the log:\n%s", event, logs)
+			return
+		}
+		for k, v := range want {
+			if r[k] != v {
+				t.Errorf("%q record has %s %v, want %v: %v", event, k, r[k], v, r)
+			}
+		}
+	}
+	check("pin-wrong", map[string]any{"level": "WARN", "msg": "wrong PIN", "serial": 42.0, "retries": 2.0})
+	check("signature", map[string]any{
+		"level":       "INFO",
+		"serial":      42.0,
+		"slot":        "9a",
+		"fingerprint": ssh.FingerprintSHA256(key),
+		"connection":  7.0,
+		"msg":         "signed",
+	})
+}
+
+func TestTextLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := slog.New(newTextLogHandler(buf, true)).With("serial", 42)
+	l.Info("connecting to the YubiKey", "event", "yubikey-connect")
+	l.Debug("skipping slot", "slot", "9c")
+	if !regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d connecting to the YubiKey serial=42 event=yubikey-connect\n$`).Match(buf.Bytes()) {
+		t.Errorf("unexpected text log %q", buf)
+	}
+
+	defer logLevel.Set(logLevel.Level())
+	logLevel.Set(slog.LevelDebug)
+	buf.Reset()
+	slog.New(newTextLogHandler(buf, false)).Debug("skipping slot", "slot", "9c",
+		"error", errors.New("unsupported key"), "path", "", "exe", `a "b"=c`)
+	want := `skipping slot slot=9c error="unsupported key" path="" exe="a \"b\"=c"` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got debug log %q, want %q", got, want)
+	}
+}
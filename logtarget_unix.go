@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+)
+
+// openLogTarget returns the handler for -log-target syslog or journal.
+func openLogTarget(target string) (slog.Handler, error) {
+	switch target {
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "yubikey-agent")
+		if err != nil {
+			return nil, err
+		}
+		return newSyslogHandler(w), nil
+	case "journal":
+		return newJournalHandler()
+	}
+	return nil, fmt.Errorf("unknown log target %q", target)
+}
+
+// newSyslogHandler returns a handler that sends each record to syslog, with
+// the severity of its level. Syslog has no structured fields, so the
+// attributes are appended to the message by formatLogLine.
+func newSyslogHandler(w *syslog.Writer) slog.Handler {
+	return &recordHandler{emit: func(r slog.Record, attrs []slog.Attr) error {
+		line := formatLogLine(r.Message, attrs)
+		switch {
+		case r.Level >= slog.LevelError:
+			return w.Err(line)
+		case r.Level >= slog.LevelWarn:
+			return w.Warning(line)
+		case r.Level >= slog.LevelInfo:
+			return w.Info(line)
+		default:
+			return w.Debug(line)
+		}
+	}}
+}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// newJournalHandler returns a handler that sends each record to the systemd
+// journal with its native protocol, with the priority of its level and its
+// attributes, like SERIAL and SLOT, as journal fields that can be queried with
+// journalctl. See systemd.journal-fields(7). journalctl only shows MESSAGE by
+// default, so that also has the attributes, formatted by formatLogLine, while
+// LOG_MESSAGE has the constant message, for grouping.
+func newJournalHandler() (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &recordHandler{emit: func(r slog.Record, attrs []slog.Attr) error {
+		_, err := conn.Write(journalEntry(r, attrs))
+		return err
+	}}, nil
+}
+
+// journalEntry encodes a record for the journal native protocol.
+func journalEntry(r slog.Record, attrs []slog.Attr) []byte {
+	priority := "7" // debug
+	switch {
+	case r.Level >= slog.LevelError:
+		priority = "3"
+	case r.Level >= slog.LevelWarn:
+		priority = "4"
+	case r.Level >= slog.LevelInfo:
+		priority = "6"
+	}
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", formatLogLine(r.Message, attrs))
+	writeJournalField(&b, "LOG_MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", priority)
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "yubikey-agent")
+	writeJournalField(&b, "SYSLOG_PID", fmt.Sprint(os.Getpid()))
+	for _, a := range attrs {
+		writeJournalField(&b, strings.ToUpper(a.Key), a.Value.String())
+	}
+	return b.Bytes()
+}
+
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	// Values with newlines are written as their length and the raw bytes.
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJournalEntry(t *testing.T) {
+	r := slog.NewRecord(time.Now(), slog.LevelWarn, "wrong PIN", 0)
+	r.AddAttrs(slog.String("event", "pin-wrong"), slog.Any("serial", uint32(42)), slog.Int("retries", 2))
+	attrs := []slog.Attr{slog.String("slot", "9a"), slog.Any("error", errors.New("two\nlines"))}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	var want bytes.Buffer
+	want.WriteString(`MESSAGE=wrong PIN slot=9a error="two\nlines" event=pin-wrong serial=42 retries=2` + "\n")
+	want.WriteString("LOG_MESSAGE=wrong PIN\n")
+	want.WriteString("PRIORITY=4\n")
+	want.WriteString("SYSLOG_IDENTIFIER=yubikey-agent\n")
+	fmt.Fprintf(&want, "SYSLOG_PID=%d\n", os.Getpid())
+	want.WriteString("SLOT=9a\n")
+	want.WriteString("ERROR\n")
+	binary.Write(&want, binary.LittleEndian, uint64(len("two\nlines")))
+	want.WriteString("two\nlines\n")
+	want.WriteString("EVENT=pin-wrong\n")
+	want.WriteString("SERIAL=42\n")
+	want.WriteString("RETRIES=2\n")
+	if got := journalEntry(r, attrs); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("got journal entry %q, want %q", got, want.Bytes())
+	}
+}
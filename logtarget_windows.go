@@ -0,0 +1,18 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// openLogTarget fails, as there is no syslog or journal on Windows. The
+// Windows service logs to the Event Log instead.
+func openLogTarget(target string) (slog.Handler, error) {
+	return nil, fmt.Errorf("-log-target %s is not available on Windows", target)
+}
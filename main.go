@@ -9,26 +9,34 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/go-piv/piv-go/piv"
+	"github.com/go-piv/piv-go/v2/piv"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
@@ -38,19 +46,119 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of yubikey-agent:\n")
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "\tyubikey-agent -setup\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -setup [-backup]\n")
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "\t\tGenerate a new SSH key on the attached YubiKey.\n")
+		fmt.Fprintf(os.Stderr, "\t\tGenerate a new SSH key on the attached YubiKey, and with -backup\n")
+		fmt.Fprintf(os.Stderr, "\t\ton a second one, to register both.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -list [-json]\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -info [-json]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tShow the keys on the attached YubiKey, and with -info its serial\n")
+		fmt.Fprintf(os.Stderr, "\t\tnumber, firmware version, and remaining PIN retries.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -list-devices [-json]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tShow the serial number and firmware version of all the attached\n")
+		fmt.Fprintf(os.Stderr, "\t\tYubiKeys, and any other smart cards.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -attest [-slot SLOT] [-verify [-json]]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint the attestation certificate chain for the key in SLOT (9a by\n")
+		fmt.Fprintf(os.Stderr, "\t\tdefault), or with -verify check it and show the attested details.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -export PATH\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tWrite a zip file at PATH with the public keys, certificates, and\n")
+		fmt.Fprintf(os.Stderr, "\t\tattestations of the keys on the attached YubiKey, as a backup.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -recert [-slot SLOT]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tReplace the certificate for the key in SLOT (9a by default) with a\n")
+		fmt.Fprintf(os.Stderr, "\t\tnew self-signed one, keeping the same key.\n")
 		fmt.Fprintf(os.Stderr, "\n")
 		fmt.Fprintf(os.Stderr, "\tyubikey-agent -l PATH\n")
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "\t\tRun the agent, listening on the UNIX socket at PATH.\n")
+		fmt.Fprintf(os.Stderr, "\t\tRun the agent, listening on the UNIX socket at PATH. Without -l,\n")
+		fmt.Fprintf(os.Stderr, "\t\tthe socket is in $XDG_RUNTIME_DIR/yubikey-agent/ if set.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -print-socket [-l PATH]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tPrint a shell command setting SSH_AUTH_SOCK to the agent socket,\n")
+		fmt.Fprintf(os.Stderr, "\t\tfor eval \"$(yubikey-agent -print-socket)\".\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\tyubikey-agent -test-notify [-no-notify] [-notify-command PROGRAM]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "\t\tShow a test notification, to check that touch notifications work.\n")
 		fmt.Fprintf(os.Stderr, "\n")
 	}
 
-	socketPath := flag.String("l", "", "agent: path of the UNIX socket to listen on")
+	var socketPaths socketPathsFlag
+	flag.Var(&socketPaths, "l", "agent: path of the UNIX socket to listen on, or a unix:// or tcp:// address (can be repeated, or comma-separated)")
+	var restrictedPaths socketPathsFlag
+	flag.Var(&restrictedPaths, "restricted-l", "agent: like -l, but every signature needs confirmation and ssh-add can't change keys, for forwarding")
+	printSocketFlag := flag.Bool("print-socket", false, "print an export SSH_AUTH_SOCK=... line for the agent socket")
+	cygwinSocketFlag := flag.String("cygwin-socket", "", "agent: path of a Cygwin/MSYS2 socket to listen on, for Git Bash (Windows only)")
+	installServiceFlag := flag.Bool("install-windows-service", false, "install the agent as a Windows service for the current user, with the other flags")
+	removeServiceFlag := flag.Bool("remove-windows-service", false, "remove the Windows service installed with -install-windows-service")
+	pageantFlag := flag.Bool("pageant", false, "agent: also answer PuTTY, WinSCP, and FileZilla as Pageant does (Windows only)")
+	allowRemoteFlag := flag.Bool("allow-remote", false, "agent: allow tcp:// addresses that are not loopback, reachable from other machines")
+	metricsAddrFlag := flag.String("metrics-addr", "", "agent: loopback address, like 127.0.0.1:9811, to serve Prometheus metrics on at /metrics")
+	upstreamFlag := flag.String("upstream", "", "agent: socket of another agent, like ssh-agent, whose keys are offered alongside the YubiKey's")
+	allowedKeysFlag := flag.String("allowed-keys", "", "agent: file of SHA256 fingerprints or public keys, the only ones offered and used")
+	socketModeFlag := flag.String("socket-mode", "0600", "agent: permissions of the UNIX socket, in octal")
+	backupFlag := flag.Bool("backup", false, "setup: also set up a second YubiKey as a backup, swapping them when asked")
 	resetFlag := flag.Bool("really-delete-all-piv-keys", false, "setup: reset the PIV applet")
+	minRetriesFlag := flag.Int("min-pin-retries", 1, "agent: stop asking again for a wrong PIN when this many retries remain")
+	retriesWarningFlag := flag.Int("pin-retries-warning", 1, "agent: notify when a wrong PIN leaves this many retries or fewer")
+	pinTimeoutFlag := flag.Duration("pin-timeout", 3*time.Minute, "agent: dismiss unanswered PIN prompts after this long (0 to disable)")
+	waitFlag := flag.Duration("wait", 0, "wait this long for a YubiKey to be inserted if none is connected")
+	connTimeoutFlag := flag.Duration("conn-timeout", 5*time.Minute, "agent: disconnect clients idle for this long (0 to disable)")
+	noPINCacheFlag := flag.Bool("no-pin-cache", os.Getenv("YUBIKEY_AGENT_NO_PIN_CACHE") != "", "agent: never read or store the PIN in a cache (or set YUBIKEY_AGENT_NO_PIN_CACHE)")
+	noNotifyFlag := flag.Bool("no-notify", os.Getenv("YUBIKEY_AGENT_NO_NOTIFICATIONS") != "", "agent: don't show desktop notifications, only log them (or set YUBIKEY_AGENT_NO_NOTIFICATIONS)")
+	flag.BoolVar(noNotifyFlag, "no-notifications", *noNotifyFlag, "agent: alias for -no-notify")
+	testNotifyFlag := flag.Bool("test-notify", false, "show a test notification, to check the notification setup, and exit")
+	touchNotifyDelayFlag := flag.Duration("touch-notify-delay", 300*time.Millisecond, "agent: wait this long for a touch before showing a notification")
+	notifyCommandFlag := flag.String("notify-command", "", "agent: program to run with the message instead of showing desktop notifications")
+	touchTTYFlag := flag.String("touch-tty", "", "agent: terminal to ring the bell on when a touch is needed, like /dev/pts/3")
+	touchHintFileFlag := flag.String("touch-hint-file", "", "agent: file to write 1 to while a touch is needed, and 0 otherwise")
+	touchSoundFlag := flag.Bool("touch-notify-sound", false, "agent: play a sound when a touch is needed (macOS only)")
+	slotsFlag := flag.String("slots", "9a", "agent: comma-separated PIV slots to offer keys from (9a, 9c, 9d, 9e, or 82-95)")
+	pinCacheTTLFlag := flag.Duration("pin-cache-ttl", 0, "agent: cache the PIN in the kernel keyring for this long (Linux only)")
+	pinMemoryTTLFlag := flag.Duration("pin-memory-ttl", 0, "agent: remember the PIN in memory for this long, across reconnections")
+	pinCommandFlag := flag.String("pin-command", "", "agent: shell command that prints the PIN, tried before prompting")
+	alwaysConfirmFlag := flag.Bool("always-confirm", false, "agent: ask for confirmation before every signature")
+	confirmForwardedFlag := flag.Bool("confirm-forwarded", false, "agent: ask for confirmation before signing for forwarded connections")
+	pinFDFlag := flag.Int("pin-fd", -1, "agent: read the PIN from this file descriptor at startup, and remember it in memory until exit, or for -pin-memory-ttl")
+	askPINFlag := flag.Bool("ask-pin-at-start", false, "agent: prompt for the PIN at startup, and remember it in memory until exit, or for -pin-memory-ttl")
+	forgetPINFlag := flag.Bool("forget-pin", false, "discard the PINs cached with -pin-cache-ttl in the session keyring")
+	savePINFlag := flag.Bool("save-pin", false, "agent: save the PIN in the Secret Service keyring (Linux only)")
+	watchFlag := flag.Bool("watch", false, "agent: connect to the YubiKey as soon as it's inserted, polling every few seconds")
+	quietFlag := flag.Bool("quiet", false, "agent: don't log routine events, like connecting to the YubiKey")
+	logFormatFlag := flag.String("log-format", "text", "agent: format of the log, text or json")
+	logTargetFlag := flag.String("log-target", "stderr", "agent: where to log, stderr, syslog, or journal")
+	debugFlag := flag.Bool("debug", false, "agent: log more details, like why keys are skipped and every agent request")
+	flag.BoolVar(debugFlag, "v", *debugFlag, "agent: alias for -debug")
+	debugAddrFlag := flag.String("debug-addr", "", "agent: loopback address, like 127.0.0.1:0, to serve Go profiles on at /debug/pprof/")
+	allowUIDFlag := flag.String("allow-uid", "", "agent: comma-separated uids, other than the current user, that can connect to the agent")
+	forceFlag := flag.Bool("force", false, "agent: replace another agent already listening on the socket")
+	flag.BoolVar(forceFlag, "takeover", *forceFlag, "agent: alias for -force")
 	setupFlag := flag.Bool("setup", false, "setup: configure a new YubiKey")
+	listFlag := flag.Bool("list", false, "list: show the keys on the YubiKey")
+	infoFlag := flag.Bool("info", false, "list: show the YubiKey details and keys")
+	listDevicesFlag := flag.Bool("list-devices", false, "list: show all the attached YubiKeys")
+	attestFlag := flag.Bool("attest", false, "attest: print the attestation certificates for a slot")
+	exportFlag := flag.String("export", "", "export: path of the zip file to write")
+	recertFlag := flag.Bool("recert", false, "recert: replace the certificate for a slot, keeping the key")
+	addKeyFlag := flag.Bool("add-key", false, "add-key: generate a new key in an empty slot of a YubiKey set up with -setup")
+	touchPolicyFlag := flag.String("touch-policy", "always", "add-key: when the key needs a touch (always, cached, or never)")
+	pinPolicyFlag := flag.String("pin-policy", "once", "add-key: when the key needs the PIN (once, always, or never)")
+	algorithmFlag := flag.String("algorithm", "ecdsa-p256", "add-key: the key algorithm (ecdsa-p256, ecdsa-p384, or rsa2048)")
+	attestSlotFlag := flag.String("slot", "9a", "attest, recert, add-key: the PIV slot to use")
+	verifyFlag := flag.Bool("verify", false, "attest: verify the attestation instead of printing it")
+	jsonFlag := flag.Bool("json", false, "list, attest: print JSON instead of text")
+	messagesFlag := flag.String("messages", os.Getenv("YUBIKEY_AGENT_MESSAGES"), "JSON file with custom prompt and notification messages (or set YUBIKEY_AGENT_MESSAGES)")
+	touchMessageFlag := flag.String("touch-message", "", "agent: template of the touch notification, like the ones in -messages")
 	flag.Parse()
 
 	if flag.NArg() > 0 {
@@ -58,200 +166,1434 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *setupFlag {
-		log.SetFlags(0)
-		yk := connectForSetup()
-		if *resetFlag {
-			runReset(yk)
+	if *messagesFlag != "" || *touchMessageFlag != "" {
+		overrides := make(map[string]string)
+		if *touchMessageFlag != "" {
+			overrides["touchNotification"] = *touchMessageFlag
 		}
-		runSetup(yk)
+		if err := loadMessages(*messagesFlag, overrides); err != nil {
+			log.Fatalln("Failed to load custom messages:", err)
+		}
+	}
+
+	// The commands print their errors and warnings without timestamps, while
+	// the agent replaces this with the handler for -log-format and -log-target.
+	slog.SetDefault(slog.New(newTextLogHandler(os.Stderr, false)))
+
+	if *installServiceFlag {
+		var args []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "install-windows-service" {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		})
+		installService(args)
+	} else if *removeServiceFlag {
+		removeService()
+	} else if *printSocketFlag {
+		if len(socketPaths) == 0 {
+			socketPaths = append(socketPaths, defaultSocketPath())
+		}
+		runPrintSocket(socketPaths)
+	} else if *testNotifyFlag {
+		if err := runTestNotify(&Agent{
+			NoNotify:      *noNotifyFlag,
+			NotifyCommand: *notifyCommandFlag,
+			TouchSound:    *touchSoundFlag,
+		}); err != nil {
+			log.Fatalln("Failed to show the test notification:", err)
+		}
+	} else if *setupFlag {
+		if *backupFlag {
+			runSetupBackup(*waitFlag, *resetFlag)
+		} else {
+			yk := connectForSetup(*waitFlag)
+			if *resetFlag {
+				runReset(yk)
+			}
+			runSetup(yk)
+		}
+	} else if *forgetPINFlag {
+		n, err := forgetKernelKeyringPINs()
+		if err != nil {
+			log.Fatalln("Failed to forget the cached PINs:", err)
+		}
+		fmt.Printf("Forgot %d cached PIN(s).\n", n)
+	} else if *attestFlag {
+		slot, err := parseSlot(*attestSlotFlag)
+		if err != nil {
+			log.Fatalln("Invalid -slot value:", err)
+		}
+		runAttest(connectForSetup(*waitFlag), slot, *verifyFlag, *jsonFlag)
+	} else if *exportFlag != "" {
+		runExport(connectForSetup(*waitFlag), *exportFlag)
+	} else if *recertFlag {
+		slot, err := parseSlot(*attestSlotFlag)
+		if err != nil {
+			log.Fatalln("Invalid -slot value:", err)
+		}
+		runRecert(connectForSetup(*waitFlag), slot)
+	} else if *addKeyFlag {
+		slot, err := parseSlot(*attestSlotFlag)
+		if err != nil {
+			log.Fatalln("Invalid -slot value:", err)
+		}
+		touchPolicy, err := parseTouchPolicy(*touchPolicyFlag)
+		if err != nil {
+			log.Fatalln("Invalid -touch-policy value:", err)
+		}
+		pinPolicy, err := parsePINPolicy(*pinPolicyFlag)
+		if err != nil {
+			log.Fatalln("Invalid -pin-policy value:", err)
+		}
+		alg, err := parseAlgorithm(*algorithmFlag)
+		if err != nil {
+			log.Fatalln("Invalid -algorithm value:", err)
+		}
+		runAddKey(connectForSetup(*waitFlag), slot, piv.Key{
+			Algorithm:   alg,
+			PINPolicy:   pinPolicy,
+			TouchPolicy: touchPolicy,
+		})
+	} else if *listDevicesFlag {
+		runListDevices(*jsonFlag)
+	} else if *listFlag || *infoFlag {
+		runList(connectForSetup(*waitFlag), *infoFlag, *jsonFlag)
 	} else {
-		if *socketPath == "" {
+		if *debugFlag {
+			logLevel.Set(slog.LevelDebug)
+		}
+		h := newLogHandler(*logFormatFlag, os.Stderr)
+		if h == nil {
+			log.Fatalf("Invalid -log-format value %q, it should be text or json.", *logFormatFlag)
+		}
+		var targetErr error
+		switch *logTargetFlag {
+		case "stderr":
+		case "syslog", "journal":
+			if *logFormatFlag != "text" {
+				log.Fatalln("-log-format only applies to -log-target stderr.")
+			}
+			var th slog.Handler
+			if th, targetErr = openLogTarget(*logTargetFlag); targetErr == nil {
+				h = th
+			}
+		default:
+			log.Fatalf("Invalid -log-target value %q, it should be stderr, syslog, or journal.", *logTargetFlag)
+		}
+		slog.SetDefault(slog.New(h))
+		if targetErr != nil {
+			slog.Warn("can't open the log target, logging to stderr instead", "target", *logTargetFlag, "error", targetErr)
+		}
+		if path := defaultSocketPath(); len(socketPaths) == 0 && path != "" {
+			slog.Info("no -l flag, listening on the default socket", "address", path)
+			socketPaths = append(socketPaths, path)
+		}
+		if *cygwinSocketFlag != "" {
+			socketPaths = append(socketPaths, "cygwin://"+*cygwinSocketFlag)
+		}
+		if len(socketPaths) == 0 {
 			flag.Usage()
 			os.Exit(1)
 		}
-		runAgent(*socketPath)
+		for _, path := range restrictedPaths {
+			for _, p := range socketPaths {
+				if p == path {
+					logFatal("address passed to both -l and -restricted-l", "address", path)
+				}
+			}
+		}
+		slots, err := parseSlots(*slotsFlag)
+		if err != nil {
+			logFatal("invalid -slots value", "error", err)
+		}
+		var allowedUIDs []int
+		if *allowUIDFlag != "" {
+			for _, u := range strings.Split(*allowUIDFlag, ",") {
+				uid, err := strconv.Atoi(strings.TrimSpace(u))
+				if err != nil || uid < 0 {
+					logFatal("invalid -allow-uid value", "value", u)
+				}
+				allowedUIDs = append(allowedUIDs, uid)
+			}
+		}
+		var allowedKeys map[string]bool
+		if *allowedKeysFlag != "" {
+			allowedKeys, err = loadAllowedKeys(*allowedKeysFlag)
+			if err != nil {
+				logFatal("failed to load -allowed-keys", "path", *allowedKeysFlag, "error", err)
+			}
+		}
+		var pinCache PINCache
+		var caches int
+		for _, enabled := range []bool{*savePINFlag, *pinCacheTTLFlag > 0, *pinMemoryTTLFlag > 0} {
+			if enabled {
+				caches++
+			}
+		}
+		switch {
+		case *noPINCacheFlag:
+		case caches > 1:
+			logFatal("only one of -save-pin, -pin-cache-ttl, and -pin-memory-ttl can be used")
+		case *savePINFlag:
+			pinCache, err = newSecretServiceCache()
+			if err != nil {
+				logFatal("can't use -save-pin", "error", err)
+			}
+		case *pinCacheTTLFlag > 0:
+			pinCache, err = newKernelKeyringCache(*pinCacheTTLFlag)
+			if err != nil {
+				logFatal("can't use -pin-cache-ttl", "error", err)
+			}
+		case *pinMemoryTTLFlag > 0:
+			pinCache = newMemoryPINCache(*pinMemoryTTLFlag)
+		}
+		if *pinCommandFlag != "" && *noPINCacheFlag {
+			logFatal("-pin-command can't be used with -no-pin-cache")
+		}
+		if *askPINFlag {
+			if *noPINCacheFlag {
+				logFatal("-ask-pin-at-start can't be used with -no-pin-cache")
+			}
+			if pinCache == nil {
+				pinCache = newMemoryPINCache(0)
+			}
+		}
+		var fdPIN string
+		if *pinFDFlag >= 0 {
+			if *noPINCacheFlag {
+				logFatal("-pin-fd can't be used with -no-pin-cache")
+			}
+			if *askPINFlag {
+				logFatal("-pin-fd can't be used with -ask-pin-at-start")
+			}
+			fdPIN, err = readPINFD(*pinFDFlag)
+			if err != nil {
+				logFatal("failed to read the PIN from -pin-fd", "fd", *pinFDFlag, "error", err)
+			}
+		}
+		socketMode, err := strconv.ParseUint(*socketModeFlag, 8, 32)
+		if err != nil || socketMode&^0777 != 0 {
+			logFatal("invalid -socket-mode value, it should be like 0600", "value", *socketModeFlag)
+		}
+		lo := listenOptions{
+			SocketMode:  os.FileMode(socketMode),
+			Force:       *forceFlag,
+			AllowRemote: *allowRemoteFlag,
+			Pageant:     *pageantFlag,
+			MetricsAddr: *metricsAddrFlag,
+			DebugAddr:   *debugAddrFlag,
+		}
+		a := &Agent{
+			MinPINRetries:     *minRetriesFlag,
+			PINRetriesWarning: *retriesWarningFlag,
+			PINTimeout:        *pinTimeoutFlag,
+			ConnTimeout:       *connTimeoutFlag,
+			NoPINCache:        *noPINCacheFlag,
+			PINCommand:        *pinCommandFlag,
+			ConfirmForwarded:  *confirmForwardedFlag,
+			AlwaysConfirm:     *alwaysConfirmFlag,
+			PINCache:          pinCache,
+			NoNotify:          *noNotifyFlag,
+			NotifyCommand:     *notifyCommandFlag,
+			TouchSound:        *touchSoundFlag,
+			TouchNotifyDelay:  *touchNotifyDelayFlag,
+			TouchTTY:          *touchTTYFlag,
+			TouchHintFile:     *touchHintFileFlag,
+			Slots:             slots,
+			Upstream:          *upstreamFlag,
+			AllowedKeys:       allowedKeys,
+			WaitForYubiKey:    *waitFlag,
+			Debug:             *debugFlag,
+			Quiet:             *quietFlag,
+			AllowedUIDs:       allowedUIDs,
+			unlockedPINs:      newMemoryPINCache(*pinMemoryTTLFlag).(*memoryPINCache),
+		}
+		if fdPIN != "" {
+			go func() {
+				if err := a.unlockPIN(fdPIN, 0); err != nil {
+					slog.Error("failed to use the PIN from -pin-fd, will prompt when needed", "error", err)
+				}
+			}()
+		}
+		if inService() {
+			runService(func() { runAgent(socketPaths, restrictedPaths, lo, *askPINFlag, *watchFlag, a) })
+		} else {
+			runAgent(socketPaths, restrictedPaths, lo, *askPINFlag, *watchFlag, a)
+		}
 	}
 }
 
-func runAgent(socketPath string) {
+func runAgent(addrs, restrictedAddrs []string, lo listenOptions, askPIN, watch bool, a *Agent) {
 	if terminal.IsTerminal(int(os.Stdin.Fd())) {
-		log.Println("Warning: yubikey-agent is meant to run as a background daemon.")
-		log.Println("Running multiple instances is likely to lead to conflicts.")
-		log.Println("Consider using the launchd or systemd services.")
+		slog.Warn("yubikey-agent is meant to run as a background daemon, " +
+			"running multiple instances is likely to lead to conflicts, " +
+			"consider using the launchd or systemd services")
 	}
 
-	a := &Agent{}
-
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func() {
 		for range c {
-			a.Close()
+			a.reset()
+		}
+	}()
+	dump := make(chan os.Signal, 1)
+	notifyDump(dump)
+	go func() {
+		for range dump {
+			a.dumpState()
+		}
+	}()
+
+	// Closing the listeners removes the sockets, so do it before exiting.
+	var listeners []net.Listener
+	var policies []connPolicy
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	for i, addr := range append(addrs, restrictedAddrs...) {
+		l, err := listen(addr, lo)
+		if err != nil {
+			closeListeners()
+			logFatal("failed to listen", "address", addr, "error", err)
+		}
+		listeners = append(listeners, l)
+		policies = append(policies, connPolicy{Restricted: i >= len(addrs)})
+	}
+	if lo.Pageant {
+		if err := startPageant(a); err != nil {
+			closeListeners()
+			logFatal("failed to start Pageant emulation", "error", err)
+		}
+	}
+	if lo.MetricsAddr != "" {
+		if err := serveMetrics(lo.MetricsAddr, a); err != nil {
+			closeListeners()
+			logFatal("failed to serve metrics", "address", lo.MetricsAddr, "error", err)
+		}
+	}
+	if lo.DebugAddr != "" {
+		if err := serveDebug(lo.DebugAddr); err != nil {
+			closeListeners()
+			logFatal("failed to serve profiles", "address", lo.DebugAddr, "error", err)
+		}
+	}
+	sdNotify("READY=1\nSTATUS=Listening on " + strings.Join(append(addrs, restrictedAddrs...), ", "))
+	sdWatchdog(a.healthCheck)
+
+	if a.TouchHintFile != "" {
+		writeTouchHintFile(a.TouchHintFile, false)
+	}
+
+	if watch {
+		go a.watchYK()
+	}
+
+	if askPIN {
+		go func() {
+			if err := a.askPINAtStart(); err != nil {
+				slog.Warn("failed to get the PIN at startup, will prompt when needed", "error", err)
+			}
+		}()
+	}
+
+	for i, l := range listeners {
+		go a.serve(l, policies[i])
+	}
+	sig := <-shutdown
+	slog.Info("exiting", "event", "shutdown", "signal", sig.String())
+	sdNotify("STOPPING=1")
+	closeListeners()
+	a.Close()
+}
+
+// shutdown receives the signals that make runAgent return. On Windows, the
+// service control handler also sends to it.
+var shutdown = make(chan os.Signal, 1)
+
+// listenOptions are the settings of the agent listeners.
+type listenOptions struct {
+	// SocketMode is the permissions of UNIX sockets.
+	SocketMode os.FileMode
+
+	// Force makes the agent replace another one already listening on a UNIX
+	// socket.
+	Force bool
+
+	// AllowRemote allows TCP addresses that are not loopback.
+	AllowRemote bool
+
+	// Pageant makes the agent also serve PuTTY-family clients, on Windows.
+	Pageant bool
+
+	// MetricsAddr, if not empty, is the loopback TCP address to serve
+	// metrics on, over HTTP.
+	MetricsAddr string
+
+	// DebugAddr, if not empty, is the loopback TCP address to serve profiles
+	// on, over HTTP.
+	DebugAddr string
+}
+
+// listen listens on addr, which is the path of a UNIX socket, optionally
+// prefixed by "unix://", a TCP address prefixed by "tcp://", or on Windows the
+// path of a named pipe, like \\.\pipe\openssh-ssh-agent, or of a Cygwin
+// socket prefixed by "cygwin://".
+func listen(addr string, lo listenOptions) (net.Listener, error) {
+	if hostPort, ok := strings.CutPrefix(addr, "tcp://"); ok {
+		return listenTCP(hostPort, lo.AllowRemote)
+	}
+	if path, ok := strings.CutPrefix(addr, "cygwin://"); ok {
+		return listenCygwin(path)
+	}
+	if strings.HasPrefix(addr, `\\.\pipe\`) {
+		return listenPipe(addr)
+	}
+	return listenUnix(strings.TrimPrefix(addr, "unix://"), lo)
+}
+
+// listenTCP listens on the TCP address hostPort. There is no way to tell who
+// is connecting over TCP, so it warns loudly, and refuses addresses that are
+// reachable from other machines unless allowRemote is set.
+func listenTCP(hostPort string, allowRemote bool) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	loopback := host == "localhost" || ip != nil && ip.IsLoopback()
+	if !loopback && !allowRemote {
+		return nil, errors.New("not a loopback address, use -allow-remote to listen on it anyway")
+	}
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("‼️  listening on TCP, any process that can connect to it can use the YubiKey, "+
+		"and connections are not checked like on UNIX sockets",
+		"address", l.Addr().String(), "loopback", loopback)
+	return l, nil
+}
+
+// listenUnix prepares socketPath, replacing a running agent if lo.Force is
+// set, and listens on it.
+func listenUnix(socketPath string, lo listenOptions) (net.Listener, error) {
+	if listening, name := agentListening(socketPath); listening {
+		if !lo.Force {
+			return nil, fmt.Errorf("another %s is already running, use -force to replace it", name)
+		}
+		slog.Info("replacing the running agent", "agent", name, "address", socketPath)
+	}
+	// Abstract sockets, whose names start with "@", are not in the
+	// filesystem, and go away with the last reference to them.
+	if abstract := strings.HasPrefix(socketPath, "@"); abstract && runtime.GOOS != "linux" {
+		return nil, errors.New("abstract UNIX sockets (starting with @) are only supported on Linux")
+	} else if !abstract {
+		os.Remove(socketPath)
+		// Anyone who can connect to the socket can use the keys, so only
+		// create the folder for the current user, and make sure that an
+		// existing one is not controlled by someone else.
+		if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create UNIX socket folder: %w", err)
+		}
+		if err := checkSocketDir(filepath.Dir(socketPath)); err != nil {
+			return nil, fmt.Errorf("refusing to listen in an unsafe folder: %w", err)
+		}
+	}
+	return listenSocket(socketPath, lo.SocketMode)
+}
+
+// connPolicy is the policy of a listener, which applies to all the
+// connections it accepts.
+type connPolicy struct {
+	// Restricted connections need confirmation for every signature, including
+	// the ones of the upstream agent, and can't change the keys or the state of
+	// the agents, for example with ssh-add.
+	Restricted bool
+}
+
+// serve accepts connections on l until it's closed.
+func (a *Agent) serve(l net.Listener, policy connPolicy) {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			type temporary interface {
+				Temporary() bool
+			}
+			if err, ok := err.(temporary); ok && err.Temporary() {
+				slog.Warn("temporary Accept error, sleeping 1s", "error", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			logFatal("failed to accept connections", "error", err)
+		}
+		go a.serveConn(c, policy)
+	}
+}
+
+// socketPathsFlag collects the -l flags, each of which can also be a
+// comma-separated list of paths.
+type socketPathsFlag []string
+
+func (s *socketPathsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *socketPathsFlag) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		for _, p := range *s {
+			if p == path {
+				return fmt.Errorf("%s listed more than once", path)
+			}
+		}
+		*s = append(*s, path)
+	}
+	return nil
+}
+
+// runPrintSocket prints a shell command setting SSH_AUTH_SOCK to the first of
+// paths that OpenSSH can connect to.
+func runPrintSocket(paths []string) {
+	for _, path := range paths {
+		if path == "" || strings.HasPrefix(path, "tcp://") || strings.HasPrefix(path, "@") {
+			continue
+		}
+		path = strings.TrimPrefix(path, "unix://")
+		if abs, err := filepath.Abs(path); err == nil && !strings.HasPrefix(path, `\\.\pipe\`) {
+			path = abs
+		}
+		fmt.Printf("export SSH_AUTH_SOCK='%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+		return
+	}
+	log.Fatalln("No socket path to print, pass it with -l.")
+}
+
+// agentListening reports whether an agent answers a key list request on
+// socketPath. A failure reply, for example because no YubiKey is plugged in,
+// still counts as an answer. If the agent's process can be identified, it's
+// described by name, like "agent (pid 1234)", and otherwise name is "agent".
+func agentListening(socketPath string) (listening bool, name string) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false, ""
+	}
+	defer conn.Close()
+	name = "agent"
+	if cred, err := peerCredentials(conn); err == nil && cred.PID != 0 {
+		name = fmt.Sprintf("agent (pid %d)", cred.PID)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = agent.NewClient(conn).List()
+	// x/crypto/ssh/agent reports I/O errors, including timeouts, with this
+	// prefix and doesn't wrap them.
+	return err == nil || !strings.HasPrefix(err.Error(), "agent: client error"), name
+}
+
+type Agent struct {
+	// PINPrompt is used to ask the user for the PIN, and reports whether the
+	// PIN came from a cache rather than the user. If nil, the platform default
+	// getPIN is used.
+	PINPrompt func(req PINRequest) (pin string, fromCache bool, err error)
+
+	// ConfirmPrompt is used to ask the user to allow the signature described
+	// by desc, giving up after timeout if not zero. If nil, the platform
+	// default confirm is used.
+	ConfirmPrompt func(desc string, timeout time.Duration) (bool, error)
+
+	// MinPINRetries is the number of remaining retries at or below which a
+	// wrong PIN is not prompted for again, to avoid locking the YubiKey.
+	MinPINRetries int
+
+	// PINRetriesWarning is the number of remaining retries at or below which
+	// a wrong PIN triggers a notification.
+	PINRetriesWarning int
+
+	// PINTimeout, if not zero, is how long a PIN prompt stays up before it's
+	// dismissed and the operation fails.
+	PINTimeout time.Duration
+
+	// ConnTimeout, if not zero, is how long a client connection can stay
+	// idle before it's closed.
+	ConnTimeout time.Duration
+
+	// NoPINCache makes every PIN prompt ask the user, never reading or storing
+	// the PIN in a cache such as the OS keychain.
+	NoPINCache bool
+
+	// PINCache, if not nil, is checked for the PIN before prompting the user,
+	// and stores the PIN once the YubiKey accepts it, unless NoPINCache is set.
+	PINCache PINCache
+
+	// PINCommand, if set, is a shell command that prints the PIN, tried
+	// before prompting the user. It's not used when the PIN must not come
+	// from a cache, like when fewer than two retries remain.
+	PINCommand string
+
+	// ConfirmForwarded makes the agent ask the user to allow each signature
+	// requested over a forwarded connection. Connections are known to be
+	// forwarded only if the client uses the session-bind@openssh.com
+	// extension, like OpenSSH 8.9 and later.
+	ConfirmForwarded bool
+
+	// AlwaysConfirm makes the agent ask the user to allow every signature, in
+	// addition to any touch the key requires.
+	AlwaysConfirm bool
+
+	// NoNotify disables desktop notifications of any kind. Their messages are
+	// logged instead.
+	NoNotify bool
+
+	// NotifyCommand, if set, is a program run instead of showing desktop
+	// notifications. See runNotifyCommand.
+	NotifyCommand string
+
+	// TouchNotifyDelay is how long a signature waits for a touch before the
+	// touch notification is shown, so that signatures that don't need a touch,
+	// or a touch that is cached, don't flash one.
+	TouchNotifyDelay time.Duration
+
+	// TouchSound makes the touch notification play a sound, on macOS.
+	TouchSound bool
+
+	// TouchTTY and TouchHintFile, if set, are used by touchHint.
+	TouchTTY      string
+	TouchHintFile string
+
+	// Debug logs every agent request, and brings back the routine events
+	// hidden by Quiet. The extra messages, like why keys in Slots are skipped,
+	// are logged at slog.LevelDebug.
+	Debug bool
+
+	// Quiet disables the logging of routine events, like connecting to the
+	// YubiKey, unless Debug is also set.
+	Quiet bool
+
+	// AllowedUIDs are the users, other than the one running the agent, whose
+	// processes can connect to it. Connections are checked on Linux, macOS,
+	// and FreeBSD, and only the socket permissions apply elsewhere.
+	AllowedUIDs []int
+
+	// WaitForYubiKey, if not zero, is how long an operation waits for a
+	// YubiKey to be inserted if none is connected, instead of failing.
+	WaitForYubiKey time.Duration
+
+	// Slots are the PIV slots whose keys are offered by the agent.
+	Slots []piv.Slot
+
+	// AllowedKeys, if not nil, is the set of SHA-256 fingerprints of the only
+	// keys the agent offers and signs with. Keys in Slots that are not listed
+	// are ignored, as if their slot were empty.
+	AllowedKeys map[string]bool
+
+	// Upstream, if not empty, is the socket of another agent, like ssh-agent,
+	// whose keys are offered after the YubiKey's, and which signs with them.
+	Upstream string
+
+	mu     sync.Mutex
+	yk     yubiKey
+	serial uint32
+
+	// openYubiKey, if not nil, replaces openYKWait to connect to the YubiKey,
+	// so that tests can use one that is not a physical device.
+	openYubiKey func() (yubiKey, error)
+
+	// canAttest is set if yk could read its attestation certificate when it
+	// was opened, which healthy then uses to check the connection.
+	canAttest bool
+
+	// pinErr is the last error returned by the PIN prompt. piv-go doesn't wrap
+	// PINPrompt errors, so this is the only way to tell why signing failed.
+	pinErr error
+
+	// pinBlocked is set when the PIN retries run out, to stop prompting for
+	// it. It's refreshed every time the retries counter is read.
+	pinBlocked bool
+
+	// retries is the last PIN retries count read from the YubiKey, if
+	// retriesKnown. The counter can't be read while the PIN is verified.
+	retries      int
+	retriesKnown bool
+
+	// pinFailed is set when the YubiKey rejects a PIN, until it accepts one.
+	// While it's set, a cached PIN is not tried if the retries are unknown.
+	pinFailed bool
+
+	// signerCache holds the signers prepared on signerCacheYK, so that the
+	// PIN policy of each key isn't read from the YubiKey again on every
+	// request. A new connection to the YubiKey invalidates them. The cached
+	// signers still prompt for the PIN whenever the YubiKey requires it.
+	signerCache   []slotSigner
+	signerCacheYK yubiKey
+
+	// metrics are served by serveMetrics, if -metrics-addr is set.
+	metrics metrics
+
+	// connectErr and signErr are the last errors connecting to the YubiKey
+	// and signing, reported by dumpState.
+	connectErr error
+	signErr    error
+
+	// activeConns is the number of open agent connections.
+	activeConns atomic.Int64
+
+	// listProblem is the last reason logged by List for offering no keys, so
+	// that it's only logged again when it changes.
+	listProblem string
+
+	// caller is the client that requested the signature in progress, if any.
+	caller *client
+
+	// upstreamDown and upstreamLoop are set when Upstream can't be reached,
+	// or leads back to this agent, so that it's only logged once.
+	upstreamDown atomic.Bool
+	upstreamLoop atomic.Bool
+
+	// lockHash is the SHA-256 of the passphrase the agent was locked with by
+	// "ssh-add -x", or nil if it's not locked.
+	lockHash []byte
+
+	// unlockedPINs holds the PINs from -pin-fd and "ssh-add -s". They are only
+	// ever kept in memory, even if PINCache is persistent, like the Secret
+	// Service. It's checked before PINCache, and must be set when the Agent is
+	// created for unlockPIN to work.
+	unlockedPINs *memoryPINCache
+
+	// pinExpiry forgets the PIN at the end of the lifetime requested with
+	// "ssh-add -s -t", if any.
+	pinExpiry *time.Timer
+
+	// touchNotification is armed by Sign to show a notification if waiting for
+	// more than TouchNotifyDelay for the touch operation. It is paused and reset
+	// by getPIN so it won't fire while waiting for the PIN.
+	touchNotification *time.Timer
+}
+
+var _ agent.ExtendedAgent = &Agent{}
+
+// yubiKey is the subset of *piv.YubiKey used by Agent, so that it can be
+// backed by something other than a physical device.
+type yubiKey interface {
+	AttestationCertificate() (*x509.Certificate, error)
+	Certificate(slot piv.Slot) (*x509.Certificate, error)
+	PrivateKey(slot piv.Slot, public crypto.PublicKey, auth piv.KeyAuth) (crypto.PrivateKey, error)
+	Serial() (uint32, error)
+	Version() piv.Version
+	Retries() (int, error)
+	VerifyPIN(pin string) error
+	Close() error
+}
+
+var _ yubiKey = &piv.YubiKey{}
+
+func (a *Agent) serveConn(c net.Conn, policy connPolicy) {
+	defer c.Close()
+	a.activeConns.Add(1)
+	defer a.activeConns.Add(-1)
+	cl := &client{Agent: a, id: lastClientID.Add(1), policy: policy}
+	defer func() {
+		// A bug triggered by one client's request must not take down the
+		// agent, and with it every other connection.
+		if r := recover(); r != nil {
+			slog.Error("panic while serving a request", "connection", cl.id,
+				"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		}
+	}()
+	defer cl.closeUpstream()
+	if _, ok := c.(*net.TCPConn); ok {
+		// Anyone who can reach the port can connect, as warned by listenTCP.
+		a.logInfo("connection over TCP", "event", "connection", "connection", cl.id,
+			"remote", c.RemoteAddr().String())
+	} else if !a.checkPeer(cl, c) {
+		return
+	}
+	if a.ConnTimeout > 0 {
+		c = &timeoutConn{Conn: c, timeout: a.ConnTimeout}
+	}
+	if a.Debug {
+		c = &debugConn{Conn: c, id: cl.id}
+	}
+	c = &smartcardConn{Conn: c, client: cl}
+	if err := agent.ServeAgent(cl, c); err != io.EOF {
+		slog.Error("connection ended with error", "connection", cl.id, "error", err)
+	}
+}
+
+// checkPeer identifies the process on the other end of the UNIX connection c,
+// and reports whether it's allowed to use the agent.
+func (a *Agent) checkPeer(cl *client, c net.Conn) bool {
+	cred, err := peerCredentials(c)
+	switch {
+	case errors.Is(err, errPeerCredUnsupported):
+		// Only the socket permissions protect the agent.
+	case err != nil:
+		slog.Error("connection rejected, failed to identify the peer",
+			"event", "connection", "connection", cl.id, "error", err)
+		return false
+	case !a.allowedUID(cred.UID):
+		slog.Warn("connection rejected, not the agent user, and not in -allow-uid",
+			"event", "connection", "connection", cl.id, "uid", cred.UID, "pid", cred.PID, "exe", cred.Exe)
+		return false
+	default:
+		slog.Debug("connection", "event", "connection", "connection", cl.id,
+			"uid", cred.UID, "pid", cred.PID, "exe", cred.Exe)
+		cl.peer = &cred
+	}
+	return true
+}
+
+// timeoutConn refreshes the deadline before each Read and Write, so that a
+// stuck client is eventually disconnected. The deadline doesn't run while a
+// request is being processed, which might involve waiting for a PIN or touch.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// allowedUID reports whether a process of user uid can use the agent.
+func (a *Agent) allowedUID(uid int) bool {
+	if uid == os.Getuid() {
+		return true
+	}
+	for _, u := range a.AllowedUIDs {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// healthy reports whether yk still responds. canAttest is whether yk supported
+// reading the attestation certificate when it was opened.
+func healthy(yk yubiKey, canAttest bool) bool {
+	// We can't use Serial because it locks the session on older firmwares, and
+	// can't use Retries because it fails when the session is unlocked.
+	if canAttest {
+		_, err := yk.AttestationCertificate()
+		return err == nil
+	}
+	// Old YubiKeys and other PIV cards can't attest, so read a certificate
+	// instead. An empty slot is still an answer.
+	_, err := yk.Certificate(piv.SlotAuthentication)
+	return err == nil || errors.Is(err, piv.ErrNotFound)
+}
+
+func (a *Agent) ensureYK() error {
+	if a.yk == nil || !healthy(a.yk, a.canAttest) {
+		if a.yk != nil {
+			a.logInfo("reconnecting to the YubiKey", "event", "yubikey-connect")
+			a.yk.Close()
+		} else {
+			a.logInfo("connecting to the YubiKey", "event", "yubikey-connect")
+		}
+		yk, err := a.connectToYK()
+		if errors.Is(err, errNoYubiKey) {
+			sdNotify("STATUS=Waiting for YubiKey")
+		}
+		if err != nil {
+			a.connectErr = err
+			return err
+		}
+		a.yk = yk
+		a.metrics.countConnect()
+	}
+	return nil
+}
+
+// healthCheck is run by the service manager watchdog. If the connection to the
+// YubiKey stopped working, it's dropped, so that the next operation connects
+// again, and then it fails only if the smart card service can't be reached.
+// An unplugged YubiKey is not a failure.
+func (a *Agent) healthCheck() error {
+	if !a.mu.TryLock() {
+		// An operation is in progress, maybe waiting for a touch or the PIN.
+		return nil
+	}
+	defer a.mu.Unlock()
+	if a.yk != nil {
+		if healthy(a.yk, a.canAttest) {
+			return nil
+		}
+		a.logInfo("the connection to the YubiKey stopped working, dropping it", "serial", a.serial)
+		a.yk.Close()
+		a.yk = nil
+	}
+	if _, err := piv.Cards(); err != nil {
+		return fmt.Errorf("smart card service unreachable: %w", err)
+	}
+	return nil
+}
+
+// logInfo logs routine events, like connections, unless Quiet is set without
+// Debug. Errors and signatures are always logged.
+func (a *Agent) logInfo(msg string, args ...any) {
+	if a.Quiet && !a.Debug {
+		return
+	}
+	slog.Info(msg, args...)
+}
+
+func (a *Agent) maybeReleaseYK() {
+	// On macOS, YubiKey 5s persist the PIN cache even across sessions (and even
+	// processes), so we can release the lock on the key, to let other
+	// applications like age-plugin-yubikey use it.
+	if runtime.GOOS != "darwin" || a.yk.Version().Major < 5 {
+		return
+	}
+	if err := a.yk.Close(); err != nil {
+		slog.Error("failed to automatically release the YubiKey lock", "serial", a.serial, "error", err)
+	}
+	a.yk = nil
+}
+
+func (a *Agent) connectToYK() (yubiKey, error) {
+	var yk yubiKey
+	var err error
+	if a.openYubiKey != nil {
+		yk, err = a.openYubiKey()
+	} else {
+		yk, err = openYKWait(a.WaitForYubiKey, a.Slots...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Cache the serial number locally because requesting it on older firmwares
+	// requires switching application, which drops the PIN cache.
+	serial, _ := yk.Serial()
+	if serial != a.serial {
+		a.retriesKnown, a.pinFailed = false, false
+	}
+	a.serial = serial
+	if r, err := yk.Retries(); err == nil {
+		a.setRetries(r)
+	}
+	_, err = yk.AttestationCertificate()
+	a.canAttest = err == nil
+	if !a.canAttest {
+		slog.Debug("the YubiKey can't attest keys, checking its connection with certificate reads",
+			"serial", serial, "error", err)
+	}
+	return yk, nil
+}
+
+func (a *Agent) setRetries(r int) {
+	a.retries, a.retriesKnown = r, true
+	a.pinBlocked = r == 0
+	if a.pinBlocked {
+		sdNotify(fmt.Sprintf("STATUS=PIN blocked on YubiKey #%d", a.serial))
+	}
+}
+
+// lastRetries reads the PIN retries count if the YubiKey allows it, and
+// returns the last known value, or -1 if it was never read.
+func (a *Agent) lastRetries() int {
+	if r, err := a.yk.Retries(); err == nil {
+		a.setRetries(r)
+	}
+	if !a.retriesKnown {
+		return -1
+	}
+	return a.retries
+}
+
+var errNoYubiKey = errors.New("no YubiKey detected")
+
+// openYK opens the first YubiKey that has a certificate in one of slots, to
+// skip smart cards and YubiKeys that are not set up. If none has, or if no
+// slots are given, it opens the first one that opens successfully, to skip any
+// internal unused smart card readers.
+func openYK(slots ...piv.Slot) (*piv.YubiKey, error) {
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, errNoYubiKey
+	}
+	// TODO: support multiple YubiKeys at the same time.
+	var fallback *piv.YubiKey
+	for _, card := range cards {
+		var yk *piv.YubiKey
+		yk, err = piv.Open(card)
+		if err != nil {
+			continue
+		}
+		if hasCertificate(yk, slots) {
+			if fallback != nil {
+				fallback.Close()
+			}
+			return yk, nil
+		}
+		if fallback == nil {
+			fallback = yk
+		} else {
+			yk.Close()
+		}
+	}
+	if fallback == nil {
+		return nil, err
+	}
+	return fallback, nil
+}
+
+// openYKWait is like openYK, but if no YubiKey is connected it waits up to
+// timeout for one to be inserted.
+func openYKWait(timeout time.Duration, slots ...piv.Slot) (*piv.YubiKey, error) {
+	yk, err := openYK(slots...)
+	if !errors.Is(err, errNoYubiKey) || timeout <= 0 {
+		return yk, err
+	}
+	slog.Info("waiting for a YubiKey", "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		yk, err = openYK(slots...)
+		if !errors.Is(err, errNoYubiKey) {
+			return yk, err
+		}
+	}
+	return nil, err
+}
+
+func hasCertificate(yk *piv.YubiKey, slots []piv.Slot) bool {
+	for _, slot := range slots {
+		if _, err := yk.Certificate(slot); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Agent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// A PIN only held in memory would not survive the agent anyway, so zero
+	// it now. Persistent caches are left alone.
+	if c, ok := a.PINCache.(*memoryPINCache); ok {
+		c.forget()
+	}
+	if a.unlockedPINs != nil {
+		a.unlockedPINs.forget()
+	}
+	return a.closeYK()
+}
+
+func (a *Agent) closeYK() error {
+	if a.yk != nil {
+		slog.Info("dropping the YubiKey transaction", "serial", a.serial)
+		err := a.yk.Close()
+		a.yk = nil
+		return err
+	}
+	return nil
+}
+
+// reset handles SIGHUP: it forgets the PIN and drops the YubiKey transaction,
+// so that other applications can use the YubiKey, and the next operation
+// reconnects and asks for the PIN again. There is no configuration to reload.
+//
+// Both happen under a.mu, so an operation in progress, like a signature
+// waiting for a touch, completes first, and none can run in between.
+func (a *Agent) reset() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	slog.Info("received HUP, resetting", "event", "reset")
+	a.forgetPINLocked()
+	return a.closeYK()
+}
+
+// askPINAtStart prompts for the PIN and stores it in PINCache, so that later
+// operations don't have to.
+func (a *Agent) askPINAtStart() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		return fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	defer a.maybeReleaseYK()
+
+	keys, err := a.publicKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys found")
+	}
+	pin, err := a.promptPIN(keys[0])
+	if err != nil {
+		return err
+	}
+	a.PINCache.Set(a.serial, pin)
+	slog.Info("PIN verified and remembered", "event", "pin-verified", "serial", a.serial)
+
+	return nil
+}
+
+// forgetPIN discards the PIN of the last seen YubiKey from PINCache, if any,
+// and any PIN held in memory, including the ones from -pin-fd and "ssh-add -s".
+func (a *Agent) forgetPIN() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.forgetPINLocked()
+}
+
+func (a *Agent) forgetPINLocked() {
+	if a.unlockedPINs != nil {
+		a.unlockedPINs.forget()
+	}
+	if c, ok := a.PINCache.(*memoryPINCache); ok {
+		// It holds at most one PIN, which might be of a YubiKey that was
+		// unplugged since, and is not worth keeping either.
+		c.forget()
+	} else if a.PINCache != nil && a.serial != 0 {
+		a.PINCache.Delete(a.serial)
+	}
+}
+
+// A PINRequest describes the context in which the user is asked for the PIN.
+type PINRequest struct {
+	Serial uint32
+
+	// Retries is the number of PIN retries left, or -1 if unknown.
+	Retries int
+
+	// Slot and Fingerprint identify the key the PIN is needed for.
+	Slot        piv.Slot
+	Fingerprint string
+
+	// HostKey is the SHA-256 fingerprint of the host key of the server the
+	// client is authenticating to, if known.
+	HostKey string
+
+	// Host is the name of that server, if its host key is in known_hosts.
+	Host string
+
+	// PID and Program identify the process that made the request, if known.
+	PID     int
+	Program string
+
+	// WrongPIN is set if the user is being asked again because the previous
+	// PIN was rejected by the YubiKey.
+	WrongPIN bool
+
+	// NoCache is set if the PIN must come from the user, not from a cache.
+	NoCache bool
+
+	// Timeout, if not zero, is how long to wait for the user before giving
+	// up with ErrPINTimeout.
+	Timeout time.Duration
+}
+
+// RetriesText returns Retries formatted for display.
+func (r PINRequest) RetriesText() string {
+	if r.Retries < 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(r.Retries)
+}
+
+// ErrPINCancelled is returned by the PIN prompt if the user dismissed it.
+var ErrPINCancelled = errors.New("PIN entry cancelled")
+
+// ErrPINTimeout is returned by the PIN prompt if the user didn't respond in
+// time. It wraps ErrPINCancelled.
+var ErrPINTimeout = fmt.Errorf("PIN prompt timed out: %w", ErrPINCancelled)
+
+// ErrPINBlocked is returned instead of prompting for the PIN once it's
+// blocked by too many wrong attempts.
+var ErrPINBlocked = errors.New(`the PIN is blocked, unblock it with the PUK using "ykman piv access unblock-pin"`)
+
+func (a *Agent) getPIN(k slotKey) (string, error) {
+	pin, err := a.promptPIN(k)
+	a.pinErr = err
+	return pin, err
+}
+
+func (a *Agent) promptPIN(k slotKey) (string, error) {
+	if a.touchNotification != nil && a.touchNotification.Stop() {
+		defer a.touchNotification.Reset(a.TouchNotifyDelay)
+	}
+	prompt := a.PINPrompt
+	if prompt == nil {
+		prompt = getPIN
+	}
+	if cmd := a.PINCommand; cmd != "" {
+		userPrompt := prompt
+		prompt = func(req PINRequest) (string, bool, error) {
+			// A PIN from a password manager might be stale like a cached one,
+			// so it's subject to the same rules.
+			if !req.NoCache {
+				pin, err := runPINCommand(cmd, req)
+				if err == nil {
+					return pin, true, nil
+				}
+				slog.Warn("PIN command failed, prompting instead", "serial", req.Serial, "error", err)
+			}
+			return userPrompt(req)
 		}
-	}()
-
-	os.Remove(socketPath)
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0777); err != nil {
-		log.Fatalln("Failed to create UNIX socket folder:", err)
 	}
-	l, err := net.Listen("unix", socketPath)
-	if err != nil {
-		log.Fatalln("Failed to listen on UNIX socket:", err)
+	if a.PINCache != nil {
+		prompt = cachedPINPrompt(a.PINCache, prompt)
 	}
-
+	if a.unlockedPINs != nil {
+		prompt = cachedPINPrompt(a.unlockedPINs, prompt)
+	}
+	req := a.describe(a.caller, k.pk)
+	req.Slot = k.slot
+	req.Timeout = a.PINTimeout
+	req.Retries = a.lastRetries()
+	if a.pinBlocked {
+		return "", ErrPINBlocked
+	}
+	req.NoCache = a.noPINCache(req.Retries)
 	for {
-		c, err := l.Accept()
+		start := time.Now()
+		pin, fromCache, err := prompt(req)
+		if !fromCache {
+			a.metrics.observePINPrompt(time.Since(start))
+		}
 		if err != nil {
-			type temporary interface {
-				Temporary() bool
+			return "", err
+		}
+		// Verify the PIN before handing it to piv-go, so that a typo leads to
+		// another prompt instead of failing the whole operation.
+		err = a.yk.VerifyPIN(pin)
+		var authErr piv.AuthErr
+		if !errors.As(err, &authErr) {
+			if err == nil {
+				// The counter is reset, to a maximum we don't know.
+				a.retriesKnown, a.pinFailed = false, false
 			}
-			if err, ok := err.(temporary); ok && err.Temporary() {
-				log.Println("Temporary Accept error, sleeping 1s:", err)
-				time.Sleep(1 * time.Second)
-				continue
+			if err == nil && !fromCache {
+				pinAccepted(a.serial, pin)
+				if a.PINCache != nil && !a.NoPINCache {
+					a.PINCache.Set(a.serial, pin)
+				}
 			}
-			log.Fatalln("Failed to accept connections:", err)
+			return pin, err
 		}
-		go a.serveConn(c)
-	}
-}
-
-type Agent struct {
-	mu     sync.Mutex
-	yk     *piv.YubiKey
-	serial uint32
-
-	// touchNotification is armed by Sign to show a notification if waiting for
-	// more than a few seconds for the touch operation. It is paused and reset
-	// by getPIN so it won't fire while waiting for the PIN.
-	touchNotification *time.Timer
-}
-
-var _ agent.ExtendedAgent = &Agent{}
+		slog.Warn("wrong PIN", "event", "pin-wrong", "serial", a.serial, "retries", authErr.Retries)
+		a.pinFailed = true
+		if fromCache {
+			if a.PINCache != nil {
+				a.PINCache.Delete(a.serial)
+			}
+			if a.unlockedPINs != nil {
+				a.unlockedPINs.Delete(a.serial)
+			}
+			if err := forgetCachedPIN(a.serial); err != nil {
+				slog.Error("failed to discard the cached PIN", "serial", a.serial, "error", err)
+			} else {
+				slog.Info("discarded the cached PIN, which was rejected by the YubiKey", "serial", a.serial)
+			}
+			// Don't trust the cache again for this operation, even if it
+			// couldn't be cleared, and go back to asking the user.
+			req.NoCache = true
+		}
+		a.setRetries(authErr.Retries)
+		if authErr.Retries == 0 {
+			slog.Warn("PIN blocked", "event", "pin-blocked", "serial", a.serial)
+			return "", ErrPINBlocked
+		}
+		if authErr.Retries <= a.PINRetriesWarning {
+			slog.Warn("few PIN retries remaining", "event", "pin-retries-low", "serial", a.serial,
+				"retries", authErr.Retries)
 
-func (a *Agent) serveConn(c net.Conn) {
-	if err := agent.ServeAgent(a, c); err != io.EOF {
-		log.Println("Agent client connection ended with error:", err)
+			r := req
+			r.Retries = authErr.Retries
+			a.notify(context.Background(), "pin-retries-low", r, message("pinRetriesNotification", r), false)
+		}
+		if authErr.Retries <= a.MinPINRetries {
+			return "", fmt.Errorf("not asking again for the PIN: %w", err)
+		}
+		req.Retries = authErr.Retries
+		req.WrongPIN = true
+		req.NoCache = req.NoCache || a.noPINCache(req.Retries)
 	}
 }
 
-func healthy(yk *piv.YubiKey) bool {
-	// We can't use Serial because it locks the session on older firmwares, and
-	// can't use Retries because it fails when the session is unlocked.
-	_, err := yk.AttestationCertificate()
-	return err == nil
-}
-
-func (a *Agent) ensureYK() error {
-	if a.yk == nil || !healthy(a.yk) {
-		if a.yk != nil {
-			log.Println("Reconnecting to the YubiKey...")
-			a.yk.Close()
-		} else {
-			log.Println("Connecting to the YubiKey...")
-		}
-		yk, err := a.connectToYK()
-		if err != nil {
-			return err
+// cachedPINPrompt returns a PIN prompt that checks cache before falling back
+// to prompt, unless the request says not to.
+func cachedPINPrompt(cache PINCache, prompt func(PINRequest) (string, bool, error)) func(PINRequest) (string, bool, error) {
+	return func(req PINRequest) (string, bool, error) {
+		if !req.NoCache {
+			if pin, ok := cache.Get(req.Serial); ok {
+				return pin, true, nil
+			}
 		}
-		a.yk = yk
+		return prompt(req)
 	}
-	return nil
 }
 
-func (a *Agent) maybeReleaseYK() {
-	// On macOS, YubiKey 5s persist the PIN cache even across sessions (and even
-	// processes), so we can release the lock on the key, to let other
-	// applications like age-plugin-yubikey use it.
-	if runtime.GOOS != "darwin" || a.yk.Version().Major < 5 {
-		return
+// noPINCache reports whether a prompt with retries left (or -1 if unknown)
+// must ask the user, because a cached PIN might be stale, and it's not worth
+// risking one of the last retries on it.
+func (a *Agent) noPINCache(retries int) bool {
+	if a.NoPINCache {
+		return true
 	}
-	if err := a.yk.Close(); err != nil {
-		log.Println("Failed to automatically release YubiKey lock:", err)
+	if retries < 0 {
+		// If the count was never read, it's most likely because the PIN is
+		// already verified, so there is no reason to distrust the cache,
+		// unless a PIN was rejected since the last one was accepted.
+		return a.pinFailed
 	}
-	a.yk = nil
+	return retries < 2
 }
 
-func (a *Agent) connectToYK() (*piv.YubiKey, error) {
-	yk, err := openYK()
-	if err != nil {
-		return nil, err
-	}
-	// Cache the serial number locally because requesting it on older firmwares
-	// requires switching application, which drops the PIN cache.
-	a.serial, _ = yk.Serial()
-	return yk, nil
+func (a *Agent) List() ([]*agent.Key, error) {
+	return a.list(&client{Agent: a})
 }
 
-func openYK() (yk *piv.YubiKey, err error) {
-	cards, err := piv.Cards()
+func (a *Agent) list(c *client) ([]*agent.Key, error) {
+	a.metrics.countList()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		// Like ssh-agent, a locked agent has no keys.
+		return nil, nil
+	}
+	if err := a.ensureYK(); errors.Is(err, errNoYubiKey) {
+		// A missing YubiKey is not an error, it might be in another pocket.
+		a.logListProblem("no YubiKey detected, so there are no keys to offer")
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	defer a.maybeReleaseYK()
+
+	keys, err := a.publicKeys()
+	if errors.Is(err, piv.ErrNotFound) {
+		// A YubiKey that is not set up is not an error, it just has no keys.
+		a.logListProblem(`the YubiKey slots are empty, run "yubikey-agent -setup" to create a key`,
+			"serial", a.serial, "slots", joinSlots(a.Slots))
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	if len(cards) == 0 {
-		return nil, errors.New("no YubiKey detected")
+	a.listProblem = ""
+	if c.slot != nil {
+		keys = keysInSlot(keys, *c.slot)
 	}
-	// TODO: support multiple YubiKeys. For now, select the first one that opens
-	// successfully, to skip any internal unused smart card readers.
-	for _, card := range cards {
-		yk, err = piv.Open(card)
-		if err == nil {
-			return
-		}
+	if !a.pinBlocked {
+		sdNotify(fmt.Sprintf("STATUS=Serving %d key(s) from YubiKey #%d", len(keys), a.serial))
 	}
-	return
+	var list []*agent.Key
+	for _, k := range keys {
+		// Format is the key type, so "ssh-rsa" for RSA keys even though
+		// SHA-1 signatures are not required: clients ask for rsa-sha2-256
+		// or rsa-sha2-512 with the flags handled by signWithFlags.
+		list = append(list, &agent.Key{
+			Format:  k.pk.Type(),
+			Blob:    k.pk.Marshal(),
+			Comment: fmt.Sprintf("YubiKey #%d PIV Slot %s", a.serial, k.slot),
+		})
+	}
+	return list, nil
 }
 
-func (a *Agent) Close() error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if a.yk != nil {
-		log.Println("Received HUP, dropping YubiKey transaction...")
-		err := a.yk.Close()
-		a.yk = nil
-		return err
+// logListProblem logs why List is offering no keys, with args as the fields,
+// unless it was already the reason last time.
+func (a *Agent) logListProblem(problem string, args ...any) {
+	if p := fmt.Sprint(append([]any{problem}, args...)...); p != a.listProblem {
+		slog.Warn(problem, args...)
+		a.listProblem = p
 	}
-	return nil
 }
 
-func (a *Agent) getPIN() (string, error) {
-	if a.touchNotification != nil && a.touchNotification.Stop() {
-		defer a.touchNotification.Reset(5 * time.Second)
-	}
-	r, _ := a.yk.Retries()
-	return getPIN(a.serial, r)
+// slotKey is a public key stored in a YubiKey slot.
+type slotKey struct {
+	slot piv.Slot
+	pk   ssh.PublicKey
 }
 
-func (a *Agent) List() ([]*agent.Key, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	if err := a.ensureYK(); err != nil {
-		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+func keysInSlot(keys []slotKey, slot piv.Slot) []slotKey {
+	for _, k := range keys {
+		if k.slot == slot {
+			return []slotKey{k}
+		}
 	}
-	defer a.maybeReleaseYK()
+	return nil
+}
 
-	pk, err := getPublicKey(a.yk, piv.SlotAuthentication)
-	if err != nil {
-		return nil, err
+// publicKeys returns the keys in a.Slots, skipping empty slots and keys not in
+// a.AllowedKeys. If all slots are empty, it returns a piv.ErrNotFound error.
+func (a *Agent) publicKeys() ([]slotKey, error) {
+	var keys []slotKey
+	var skipped error
+	for _, slot := range a.Slots {
+		pk, err := getPublicKey(a.yk, slot)
+		if errors.Is(err, piv.ErrNotFound) {
+			skipped = fmt.Errorf("slot %s: %w", slot, err)
+			continue
+		}
+		if errors.Is(err, errUnsupportedKey) {
+			// Don't let one unusable slot hide the others.
+			slog.Warn("skipping slot", "serial", a.serial, "slot", slot.String(), "error", err)
+			skipped = fmt.Errorf("slot %s: %w", slot, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("slot %s: %w", slot, err)
+		}
+		if a.AllowedKeys != nil && !a.AllowedKeys[ssh.FingerprintSHA256(pk)] {
+			slog.Debug("skipping slot, the key is not allowed",
+				"serial", a.serial, "slot", slot.String(), "fingerprint", ssh.FingerprintSHA256(pk))
+			continue
+
+		}
+		keys = append(keys, slotKey{slot: slot, pk: pk})
+	}
+	if len(keys) == 0 && skipped != nil {
+		return nil, skipped
 	}
-	return []*agent.Key{{
-		Format:  pk.Type(),
-		Blob:    pk.Marshal(),
-		Comment: fmt.Sprintf("YubiKey #%d PIV Slot 9a", a.serial),
-	}}, nil
+	return keys, nil
 }
 
-func getPublicKey(yk *piv.YubiKey, slot piv.Slot) (ssh.PublicKey, error) {
+// errUnsupportedKey is returned by getPublicKey for keys that can't be used
+// for SSH, like X25519 ones.
+var errUnsupportedKey = errors.New("unsupported key type")
+
+func getPublicKey(yk yubiKey, slot piv.Slot) (ssh.PublicKey, error) {
 	cert, err := yk.Certificate(slot)
 	if err != nil {
 		return nil, fmt.Errorf("could not get public key: %w", err)
 	}
-	switch cert.PublicKey.(type) {
+	switch pub := cert.PublicKey.(type) {
 	case *ecdsa.PublicKey:
+		// PIV keys can only be P-256 or P-384. A certificate for any other
+		// curve (like P-521) can be stored in a slot, but never used to sign.
+		if pub.Curve != elliptic.P256() && pub.Curve != elliptic.P384() {
+			return nil, fmt.Errorf("%w: curve %s", errUnsupportedKey, pub.Curve.Params().Name)
+		}
 	case *rsa.PublicKey:
 	default:
-		return nil, fmt.Errorf("unexpected public key type: %T", cert.PublicKey)
+		return nil, fmt.Errorf("%w: %T", errUnsupportedKey, cert.PublicKey)
 	}
 	pk, err := ssh.NewPublicKey(cert.PublicKey)
 	if err != nil {
@@ -268,27 +1610,102 @@ func (a *Agent) Signers() ([]ssh.Signer, error) {
 	}
 	defer a.maybeReleaseYK()
 
-	return a.signers()
+	signers, err := a.signers()
+	if err != nil {
+		return nil, err
+	}
+	var res []ssh.Signer
+	for _, s := range signers {
+		res = append(res, s.Signer)
+	}
+	return res, nil
+}
+
+// slotSigner is a signer for the key in slot.
+type slotSigner struct {
+	ssh.Signer
+	slot piv.Slot
 }
 
-func (a *Agent) signers() ([]ssh.Signer, error) {
-	pk, err := getPublicKey(a.yk, piv.SlotAuthentication)
+func (a *Agent) signers() ([]slotSigner, error) {
+	if a.signerCache != nil && a.signerCacheYK == a.yk {
+		return a.signerCache, nil
+	}
+	keys, err := a.publicKeys()
 	if err != nil {
 		return nil, err
 	}
-	priv, err := a.yk.PrivateKey(
-		piv.SlotAuthentication,
-		pk.(ssh.CryptoPublicKey).CryptoPublicKey(),
-		piv.KeyAuth{PINPrompt: a.getPIN},
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare private key: %w", err)
+	var signers []slotSigner
+	for _, k := range keys {
+		k := k
+		priv, err := a.yk.PrivateKey(
+			k.slot,
+			k.pk.(ssh.CryptoPublicKey).CryptoPublicKey(),
+			piv.KeyAuth{PINPrompt: func() (string, error) { return a.getPIN(k) }},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare private key: %w", err)
+		}
+		s, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare signer: %w", err)
+		}
+		signers = append(signers, slotSigner{s, k.slot})
 	}
-	s, err := ssh.NewSignerFromKey(priv)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare signer: %w", err)
+	a.signerCache, a.signerCacheYK = signers, a.yk
+	return signers, nil
+}
+
+// joinSlots returns slots like the -slots flag takes them, like "9a,9c".
+func joinSlots(slots []piv.Slot) string {
+	var names []string
+	for _, slot := range slots {
+		names = append(names, slot.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// parseSlots parses a comma-separated list of PIV slots, like "9a,9c,82".
+func parseSlots(s string) ([]piv.Slot, error) {
+	var slots []piv.Slot
+	seen := make(map[uint32]bool)
+	for _, name := range strings.Split(s, ",") {
+		slot, err := parseSlot(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		if seen[slot.Key] {
+			return nil, fmt.Errorf("slot %s listed more than once", slot)
+		}
+		seen[slot.Key] = true
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
+
+// parseSlot parses a PIV slot in hex: one of 9a, 9c, 9d, 9e, or a retired key
+// management slot between 82 and 95.
+func parseSlot(s string) (piv.Slot, error) {
+	switch strings.ToLower(s) {
+	case "9a":
+		return piv.SlotAuthentication, nil
+	case "9c":
+		return piv.SlotSignature, nil
+	case "9d":
+		return piv.SlotKeyManagement, nil
+	case "9e":
+		return piv.SlotCardAuthentication, nil
+	case "9b", "f9":
+		return piv.Slot{}, fmt.Errorf("slot %s holds the management or attestation key, not an SSH key", s)
+	case "":
+		return piv.Slot{}, errors.New("empty slot name")
+	}
+	if key, err := strconv.ParseUint(s, 16, 32); err == nil {
+		if slot, ok := piv.RetiredKeyManagementSlot(uint32(key)); ok {
+			return slot, nil
+		}
 	}
-	return []ssh.Signer{s}, nil
+	return piv.Slot{}, fmt.Errorf("unknown PIV slot %q", s)
 }
 
 func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -296,13 +1713,33 @@ func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 }
 
 func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return a.signWithFlags(&client{Agent: a}, key, data, flags)
+}
+
+func (a *Agent) signWithFlags(c *client, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if len(data) == 0 {
+		// SSH never signs empty data, so don't bother the YubiKey or the user.
+		return nil, errEmptySignRequest
+	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return nil, errAgentLocked
+	}
 	if err := a.ensureYK(); err != nil {
 		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
 	}
 	defer a.maybeReleaseYK()
 
+	a.caller = c
+	defer func() { a.caller = nil }()
+
+	if c.slot != nil {
+		pk, err := getPublicKey(a.yk, *c.slot)
+		if err != nil || !bytes.Equal(pk.Marshal(), key.Marshal()) {
+			return nil, fmt.Errorf("the requested key is not in slot %s, selected with %s", *c.slot, selectSlotExtension)
+		}
+	}
 	signers, err := a.signers()
 	if err != nil {
 		return nil, err
@@ -311,20 +1748,9 @@ func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.Signat
 		if !bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
 			continue
 		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		a.touchNotification = time.NewTimer(5 * time.Second)
-		go func() {
-			select {
-			case <-a.touchNotification.C:
-			case <-ctx.Done():
-				a.touchNotification.Stop()
-				return
-			}
-			showNotification("Waiting for YubiKey touch...")
-		}()
-
+		// For ECDSA the key type also selects the hash (RFC 5656, Section
+		// 6.2.1), which ssh.AlgorithmSigner applies: SHA-256 for nistp256 and
+		// SHA-384 for nistp384. Only RSA has a choice, negotiated via flags.
 		alg := key.Type()
 		switch {
 		case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha256 != 0:
@@ -332,28 +1758,299 @@ func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.Signat
 		case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha512 != 0:
 			alg = ssh.SigAlgoRSASHA2512
 		}
-		// TODO: maybe retry if the PIN is not correct?
-		return s.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
+		var sig *ssh.Signature
+		err := a.signGated(c, s.slot, key, false, func() (err error) {
+			sig, err = s.Signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
+			return err
+		})
+		return sig, err
+	}
+	return nil, errNoMatchingKey
+}
+
+// signGated runs sign, which makes the YubiKey sign with key, in slot, after
+// asking for confirmation if the policy of c or the Agent settings require it,
+// or if raw is set, for rawSignExtension. The user is asked at most once.
+// It shows the touch notification while the YubiKey waits, and translates and
+// reports PIN and touch failures. It must be called with a.mu held.
+func (a *Agent) signGated(c *client, slot piv.Slot, key ssh.PublicKey, raw bool, sign func() error) (err error) {
+	defer func() { a.metrics.countSign(a.serial, slot, err) }()
+
+	switch {
+	case c.policy.Restricted:
+		if err := a.confirmSignature(c, key, "confirmRestricted"); err != nil {
+			return err
+		}
+	case a.ConfirmForwarded && c.forwarded:
+		if err := a.confirmSignature(c, key, "confirmForwarded"); err != nil {
+			return err
+		}
+	case raw:
+		if err := a.confirmSignature(c, key, "confirmRawSign"); err != nil {
+			return err
+		}
+	case a.AlwaysConfirm:
+		if err := a.confirmSignature(c, key, "confirmSignature"); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t := time.NewTimer(a.TouchNotifyDelay)
+	a.touchNotification = t
+	defer func() { a.touchNotification = nil }()
+	go func() {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		req := a.describe(c, key)
+		a.touchHint(ctx, req)
+		a.touchCountdown(ctx, req)
+	}()
+
+	a.pinErr = nil
+	err = sign()
+	if err != nil && a.pinErr != nil {
+		// Nothing was submitted to the YubiKey if the prompt failed.
+		err = a.pinErr
+	}
+	var authErr piv.AuthErr
+	if errors.As(err, &authErr) && authErr.Retries == 0 {
+		a.setRetries(0)
+		err = ErrPINBlocked
+	}
+	if errors.Is(err, ErrPINBlocked) {
+		req := a.describe(c, key)
+		a.notify(context.Background(), "pin-blocked", req, message("pinBlockedNotification", req), false)
+	}
+	if isTouchTimeout(err) {
+		// Replace the touch notification, which the user missed.
+		cancel()
+		req := a.describe(c, key)
+		a.notify(context.Background(), "touch-timeout", req, message("touchTimeoutNotification", req), false)
+		err = fmt.Errorf("%w: %v", ErrTouchTimeout, err)
+	}
+	if err == nil {
+		a.logSignature(c, slot, key)
+	} else {
+		a.signErr = err
+	}
+	return err
+}
+
+var errNoMatchingKey = errors.New("no private keys match the requested public key")
+
+var errEmptySignRequest = errors.New("refusing to sign empty data")
+
+// ErrTouchTimeout is returned when the YubiKey gave up waiting for a touch.
+var ErrTouchTimeout = errors.New("touch not received, the SSH attempt failed, retry the command")
+
+// isTouchTimeout reports whether err is the "conditions of use not satisfied"
+// status the YubiKey returns when it's not touched in time.
+func isTouchTimeout(err error) bool {
+	var apduErr interface{ Status() uint16 }
+	return errors.As(err, &apduErr) && apduErr.Status() == 0x6985
+}
+
+// ErrNotConfirmed is returned when the user doesn't allow a signature that
+// needed confirmation.
+var ErrNotConfirmed = errors.New("signature not allowed by the user")
+
+// confirmSignature asks the user to allow a signature, describing it with the
+// named message.
+func (a *Agent) confirmSignature(c *client, key ssh.PublicKey, msg string) error {
+	prompt := a.ConfirmPrompt
+	if prompt == nil {
+		prompt = confirm
+	}
+	ok, err := prompt(message(msg, a.describe(c, key)), a.PINTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to ask for confirmation: %w", err)
+	}
+	if !ok {
+		slog.Info("signature denied by the user",
+			"event", "signature-denied", "connection", c.id, "fingerprint", ssh.FingerprintSHA256(key))
+		return ErrNotConfirmed
+	}
+	c.confirmed = true
+	return nil
+}
+
+// describe returns a PINRequest with the details of a signature with key
+// requested by c, for use in prompts and notifications. c can be nil.
+func (a *Agent) describe(c *client, key ssh.PublicKey) PINRequest {
+	req := PINRequest{
+		Serial:      a.serial,
+		Retries:     -1,
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}
+	if c != nil && c.hostKey != nil {
+		req.HostKey = ssh.FingerprintSHA256(c.hostKey)
+		req.Host = c.hostName
+	}
+	if c != nil && c.peer != nil {
+		req.PID, req.Program = c.peer.PID, c.peer.Exe
+	}
+	return req
+}
+
+// logSignature records a signature produced for a client, as an audit trail
+// of what the YubiKey signed, when, and for which connection.
+func (a *Agent) logSignature(c *client, slot piv.Slot, key ssh.PublicKey) {
+	args := []any{"event", "signature", "serial", a.serial, "slot", slot.String(),
+		"fingerprint", ssh.FingerprintSHA256(key)}
+	if c.id != 0 {
+		args = append(args, "connection", c.id)
+	}
+	if c.hostKey != nil {
+		args = append(args, "host_key", ssh.FingerprintSHA256(c.hostKey))
+	}
+	if c.hostName != "" {
+		args = append(args, "host", c.hostName)
+	}
+	slog.Info("signed", args...)
+}
+
+// touchTimeout is how long the YubiKey waits for a touch before failing the
+// operation. It's not configurable.
+const touchTimeout = 15 * time.Second
+
+// touchCountdownInterval is how often the touch notification is updated with
+// the time left to touch the YubiKey.
+const touchCountdownInterval = 5 * time.Second
+
+// touchCountdown shows the touch notification, and if the platform can update
+// it, keeps its countdown current until ctx is done. It's called once the
+// YubiKey has been waiting for a touch for TouchNotifyDelay.
+func (a *Agent) touchCountdown(ctx context.Context, req PINRequest) {
+	deadline := time.Now().Add(touchTimeout - a.TouchNotifyDelay)
+	if d := time.Until(deadline).Round(time.Second); d > 0 {
+		req.Timeout = d
+	}
+	update := a.notify(ctx, "touch", req, message("touchNotification", req), a.TouchSound)
+	if update == nil || req.Timeout == 0 {
+		return
+	}
+	t := time.NewTicker(touchCountdownInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		req.Timeout = time.Until(deadline).Round(time.Second)
+		if req.Timeout <= 0 {
+			return
+		}
+		update(message("touchNotification", req))
+	}
+}
+
+// notify shows a desktop notification for event, which is removed when ctx is
+// done if the platform allows it. If the platform can also change the text of
+// the notification, notify returns a function to do so, otherwise nil.
+//
+// If NotifyCommand is set, it's run instead. For events that end, that is if
+// ctx can be done, it's run once with event followed by "-start", and again
+// with "-end" when ctx is done.
+func (a *Agent) notify(ctx context.Context, event string, req PINRequest, message string, sound bool) (update func(message string)) {
+	if a.NoNotify {
+		slog.Info("notification", "event", event, "message", message)
+		return nil
+	}
+	if a.NotifyCommand == "" {
+		update, err := showNotification(ctx, message, sound)
+		if err != nil {
+			slog.Error("failed to show a notification", "event", event, "message", message, "error", err)
+		}
+		return update
 	}
-	return nil, fmt.Errorf("no private keys match the requested public key")
+	if ctx.Done() == nil {
+		runNotifyCommand(a.NotifyCommand, event, message, req)
+		return nil
+	}
+	runNotifyCommand(a.NotifyCommand, event+"-start", message, req)
+	go func() {
+		<-ctx.Done()
+		runNotifyCommand(a.NotifyCommand, event+"-end", message, req)
+	}()
+	return nil
 }
 
-func showNotification(message string) {
-	switch runtime.GOOS {
-	case "darwin":
-		message = strings.ReplaceAll(message, `\`, `\\`)
-		message = strings.ReplaceAll(message, `"`, `\"`)
-		appleScript := `display notification "%s" with title "yubikey-agent"`
-		exec.Command("osascript", "-e", fmt.Sprintf(appleScript, message)).Run()
-	case "linux":
-		exec.Command("notify-send", "-i", "dialog-password", "yubikey-agent", message).Run()
+// testNotificationDuration is how long -test-notify shows its notification.
+const testNotificationDuration = 10 * time.Second
+
+// testNotification is the message of the -test-notify notification.
+const testNotification = "This is a test notification. If you can read it, " +
+	"you'll also see when the YubiKey is waiting for a touch."
+
+// runTestNotify shows a notification the way the agent would for a touch,
+// using the -no-notify, -notify-command, and -touch-notify-sound settings. It
+// fails if the notification can't be shown, or if -notify-command fails for
+// either event.
+func runTestNotify(a *Agent) error {
+	switch {
+	case a.NoNotify:
+		fmt.Println("Notifications are disabled by -no-notify, and only logged:")
+		fmt.Println(testNotification)
+		return nil
+	case a.NotifyCommand != "":
+		fmt.Printf("Running %s with the \"test-start\" and \"test-end\" events...\n", a.NotifyCommand)
+		if err := execNotifyCommand(a.NotifyCommand, "test-start", testNotification, PINRequest{}); err != nil {
+			return fmt.Errorf("%s failed for test-start: %w", a.NotifyCommand, err)
+		}
+		time.Sleep(testNotificationDuration)
+		if err := execNotifyCommand(a.NotifyCommand, "test-end", testNotification, PINRequest{}); err != nil {
+			return fmt.Errorf("%s failed for test-end: %w", a.NotifyCommand, err)
+		}
+		return nil
 	}
+	fmt.Printf("Showing a test notification for %v...\n", testNotificationDuration)
+	ctx, cancel := context.WithTimeout(context.Background(), testNotificationDuration)
+	defer cancel()
+	if _, err := showNotification(ctx, testNotification, a.TouchSound); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	// The notification is removed in the background once ctx is done, so give
+	// that a moment before exiting.
+	time.Sleep(time.Second)
+	return nil
 }
 
+// retriesExtension is the name of an agent extension that reports how many
+// PIN retries are left. The reply is SSH_AGENT_SUCCESS followed by the count
+// as a uint32.
+const retriesExtension = "pin-retries@filippo.io"
+
 func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case retriesExtension:
+		return a.retriesExtension()
+	}
 	return nil, agent.ErrExtensionUnsupported
 }
 
+func (a *Agent) retriesExtension() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.ensureYK(); err != nil {
+		return nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	defer a.maybeReleaseYK()
+
+	retries := a.lastRetries()
+	if retries < 0 {
+		return nil, errors.New("PIN retries count not available")
+	}
+	return append([]byte{agentSuccess}, ssh.Marshal(struct{ Retries uint32 }{uint32(retries)})...), nil
+}
+
 var ErrOperationUnsupported = errors.New("operation unsupported")
 
 func (a *Agent) Add(key agent.AddedKey) error {
@@ -363,11 +2060,40 @@ func (a *Agent) Remove(key ssh.PublicKey) error {
 	return ErrOperationUnsupported
 }
 func (a *Agent) RemoveAll() error {
+	// The keys stay on the YubiKey, but forget the PIN so that the next
+	// operation needs it again.
+	a.forgetPIN()
 	return a.Close()
 }
 func (a *Agent) Lock(passphrase []byte) error {
-	return ErrOperationUnsupported
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return errAgentLocked
+	}
+	// "ssh-add -x" is also a clear request to stop using a cached PIN.
+	a.forgetPINLocked()
+	h := sha256.Sum256(passphrase)
+	a.lockHash = h[:]
+	slog.Info("agent locked", "event", "lock")
+	return nil
 }
 func (a *Agent) Unlock(passphrase []byte) error {
-	return ErrOperationUnsupported
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash == nil {
+		return errors.New("agent not locked")
+	}
+	h := sha256.Sum256(passphrase)
+	if subtle.ConstantTimeCompare(h[:], a.lockHash) != 1 {
+		return errors.New("incorrect passphrase")
+	}
+	a.lockHash = nil
+	slog.Info("agent unlocked", "event", "unlock")
+
+	return nil
 }
+
+// errAgentLocked is returned for operations on the YubiKey while the agent is
+// locked with "ssh-add -x".
+var errAgentLocked = errors.New("agent locked")
@@ -0,0 +1,922 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var w io.Writer = os.Stderr
+	if !testing.Verbose() {
+		w = io.Discard
+	}
+	slog.SetDefault(slog.New(newTextLogHandler(w, true)))
+	os.Exit(m.Run())
+}
+
+// newTestAgent returns an Agent backed by d, offering the keys in slots, and
+// asking p for the PIN. It doesn't show notifications.
+func newTestAgent(t *testing.T, d *fakeDevice, p *pinPrompter, slots ...piv.Slot) *Agent {
+	t.Helper()
+	if len(slots) == 0 {
+		slots = []piv.Slot{piv.SlotAuthentication}
+	}
+	a := &Agent{
+		PINPrompt:        p.prompt,
+		NoNotify:         true,
+		TouchNotifyDelay: time.Hour,
+		Slots:            slots,
+		openYubiKey:      d.open,
+		unlockedPINs:     newMemoryPINCache(0).(*memoryPINCache),
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// pinPrompter is a PIN prompt that answers with pins in order, and records
+// the requests it gets. Once out of PINs, it acts as if the user cancelled.
+type pinPrompter struct {
+	pins []string
+	reqs []PINRequest
+}
+
+func (p *pinPrompter) prompt(req PINRequest) (string, bool, error) {
+	p.reqs = append(p.reqs, req)
+	if len(p.pins) == 0 {
+		return "", false, ErrPINCancelled
+	}
+	pin := p.pins[0]
+	p.pins = p.pins[1:]
+	return pin, false, nil
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      map[piv.Slot]string
+		slots     []piv.Slot
+		unplugged bool
+		want      []string
+	}{
+		{
+			name:      "no YubiKey",
+			unplugged: true,
+		},
+		{
+			name: "empty",
+		},
+		{
+			name: "one key",
+			keys: map[piv.Slot]string{piv.SlotAuthentication: "p256"},
+			want: []string{"YubiKey #42 PIV Slot 9a"},
+		},
+		{
+			name: "key in another slot",
+			keys: map[piv.Slot]string{piv.SlotSignature: "p256"},
+		},
+		{
+			name:  "two slots",
+			keys:  map[piv.Slot]string{piv.SlotAuthentication: "p256", piv.SlotSignature: "p384"},
+			slots: []piv.Slot{piv.SlotAuthentication, piv.SlotSignature},
+			want:  []string{"YubiKey #42 PIV Slot 9a", "YubiKey #42 PIV Slot 9c"},
+		},
+		{
+			name:  "one of two slots",
+			keys:  map[piv.Slot]string{piv.SlotSignature: "p256"},
+			slots: []piv.Slot{piv.SlotAuthentication, piv.SlotSignature},
+			want:  []string{"YubiKey #42 PIV Slot 9c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(t, 42, tt.keys)
+			d.unplugged = tt.unplugged
+			a := newTestAgent(t, d, &pinPrompter{}, tt.slots...)
+			keys, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, k := range keys {
+				got = append(got, k.Comment)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got keys %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got keys %q, want %q", got, tt.want)
+				}
+			}
+			if d.verifies != 0 {
+				t.Errorf("List verified the PIN %d times", d.verifies)
+			}
+		})
+	}
+}
+
+func TestSignWithFlags(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{
+		piv.SlotAuthentication: "p256",
+		piv.SlotSignature:      "p256",
+	})
+	other := newFakeDevice(t, 43, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		data    []byte
+		locked  bool
+		wantErr error
+	}{
+		{
+			name: "ok",
+			key:  d.publicKey(t, piv.SlotAuthentication),
+			data: []byte("session"),
+		},
+		{
+			name:    "slot not offered",
+			key:     d.publicKey(t, piv.SlotSignature),
+			data:    []byte("session"),
+			wantErr: errNoMatchingKey,
+		},
+		{
+			name:    "unknown key",
+			key:     other.publicKey(t, piv.SlotAuthentication),
+			data:    []byte("session"),
+			wantErr: errNoMatchingKey,
+		},
+		{
+			name:    "empty data",
+			key:     d.publicKey(t, piv.SlotAuthentication),
+			wantErr: errEmptySignRequest,
+		},
+		{
+			name:    "locked",
+			key:     d.publicKey(t, piv.SlotAuthentication),
+			data:    []byte("session"),
+			locked:  true,
+			wantErr: errAgentLocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}})
+			if tt.locked {
+				if err := a.Lock([]byte("passphrase")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sig, err := a.SignWithFlags(tt.key, tt.data, 0)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.key.Verify(tt.data, sig); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestPINRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		retries        int
+		minRetries     int
+		pins           []string
+		wantErr        error
+		wantPrompts    int
+		wantRetries    int
+		wantReqRetries []int
+	}{
+		{
+			name:           "right PIN",
+			retries:        3,
+			pins:           []string{fakePIN},
+			wantPrompts:    1,
+			wantRetries:    3,
+			wantReqRetries: []int{3},
+		},
+		{
+			name:           "wrong then right PIN",
+			retries:        3,
+			pins:           []string{"000000", fakePIN},
+			wantPrompts:    2,
+			wantRetries:    3,
+			wantReqRetries: []int{3, 2},
+		},
+		{
+			name:           "stop at MinPINRetries",
+			retries:        3,
+			minRetries:     1,
+			pins:           []string{"000000", "000000", fakePIN},
+			wantErr:        piv.AuthErr{Retries: 1},
+			wantPrompts:    2,
+			wantRetries:    1,
+			wantReqRetries: []int{3, 2},
+		},
+		{
+			name:           "last retry",
+			retries:        1,
+			pins:           []string{"000000"},
+			wantErr:        ErrPINBlocked,
+			wantPrompts:    1,
+			wantRetries:    0,
+			wantReqRetries: []int{1},
+		},
+		{
+			name:        "blocked",
+			retries:     0,
+			pins:        []string{fakePIN},
+			wantErr:     ErrPINBlocked,
+			wantPrompts: 0,
+			wantRetries: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+			d.retries = tt.retries
+			p := &pinPrompter{pins: tt.pins}
+			a := newTestAgent(t, d, p)
+			a.MinPINRetries = tt.minRetries
+			_, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0)
+			if tt.wantErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(p.reqs) != tt.wantPrompts {
+				t.Errorf("prompted %d times, want %d", len(p.reqs), tt.wantPrompts)
+			}
+			for i, req := range p.reqs {
+				if i < len(tt.wantReqRetries) && req.Retries != tt.wantReqRetries[i] {
+					t.Errorf("prompt %d: Retries = %d, want %d", i, req.Retries, tt.wantReqRetries[i])
+				}
+				if req.WrongPIN != (i > 0) {
+					t.Errorf("prompt %d: WrongPIN = %v", i, req.WrongPIN)
+				}
+				if req.Serial != 42 || req.Slot != piv.SlotAuthentication {
+					t.Errorf("prompt %d: wrong YubiKey or slot: %+v", i, req)
+				}
+			}
+			if d.retries != tt.wantRetries {
+				t.Errorf("%d retries left, want %d", d.retries, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	p := &pinPrompter{pins: []string{fakePIN, fakePIN}}
+	a := newTestAgent(t, d, p)
+	key := d.publicKey(t, piv.SlotAuthentication)
+
+	sign := func() {
+		t.Helper()
+		if _, err := a.SignWithFlags(key, []byte("session"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(want int) {
+		t.Helper()
+		keys, err := a.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != want {
+			t.Fatalf("got %d keys, want %d", len(keys), want)
+		}
+	}
+
+	sign()
+	sign()
+	if d.opens != 1 || len(p.reqs) != 1 {
+		t.Fatalf("got %d connections and %d prompts, want 1 and 1", d.opens, len(p.reqs))
+	}
+
+	// A session that stops responding is replaced, and the new one needs the
+	// PIN again.
+	d.breakSession()
+	sign()
+	if d.opens != 2 || len(p.reqs) != 2 {
+		t.Fatalf("got %d connections and %d prompts, want 2 and 2", d.opens, len(p.reqs))
+	}
+	if a.metrics.reconnects != 1 {
+		t.Errorf("counted %d reconnections, want 1", a.metrics.reconnects)
+	}
+
+	// An unplugged YubiKey has no keys, and is found again once plugged back.
+	d.breakSession()
+	d.unplugged = true
+	list(0)
+	d.unplugged = false
+	list(1)
+	if d.opens != 3 {
+		t.Errorf("got %d connections, want 3", d.opens)
+	}
+
+	if _, err := a.SignWithFlags(key, []byte("session"), 0); !errors.Is(err, ErrPINCancelled) {
+		t.Errorf("got error %v after running out of PINs, want ErrPINCancelled", err)
+	}
+}
+
+func TestPINCancelled(t *testing.T) {
+	for name, cancelErr := range map[string]error{
+		"cancelled": ErrPINCancelled,
+		"timeout":   ErrPINTimeout,
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+			a := newTestAgent(t, d, &pinPrompter{})
+			a.PINPrompt = func(req PINRequest) (string, bool, error) {
+				return "", false, cancelErr
+			}
+			_, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0)
+			if !errors.Is(err, cancelErr) {
+				t.Fatalf("got error %v, want %v", err, cancelErr)
+			}
+			if d.verifies != 0 || d.retries != 3 {
+				t.Errorf("a PIN was submitted: %d verifications, %d retries left", d.verifies, d.retries)
+			}
+		})
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{
+		piv.SlotAuthentication: "p256",
+		piv.SlotSignature:      "p384",
+		piv.SlotKeyManagement:  "rsa",
+	})
+	tests := []struct {
+		name    string
+		slot    piv.Slot
+		flags   agent.SignatureFlags
+		wantAlg string
+	}{
+		{"P-256", piv.SlotAuthentication, 0, ssh.KeyAlgoECDSA256},
+		{"P-256 ignores RSA flags", piv.SlotAuthentication, agent.SignatureFlagRsaSha512, ssh.KeyAlgoECDSA256},
+		{"P-384", piv.SlotSignature, 0, ssh.KeyAlgoECDSA384},
+		{"RSA SHA-1", piv.SlotKeyManagement, 0, ssh.KeyAlgoRSA},
+		{"RSA SHA-256", piv.SlotKeyManagement, agent.SignatureFlagRsaSha256, ssh.SigAlgoRSASHA2256},
+		{"RSA SHA-512", piv.SlotKeyManagement, agent.SignatureFlagRsaSha512, ssh.SigAlgoRSASHA2512},
+	}
+	a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}},
+		piv.SlotAuthentication, piv.SlotSignature, piv.SlotKeyManagement)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := d.publicKey(t, tt.slot)
+			data := []byte("session")
+			sig, err := a.SignWithFlags(key, data, tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Format != tt.wantAlg {
+				t.Errorf("got signature format %q, want %q", sig.Format, tt.wantAlg)
+			}
+			// Verify checks that the hash matches the format, and for ECDSA
+			// the curve.
+			if err := key.Verify(data, sig); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestP521Skipped(t *testing.T) {
+	// PIV can't hold P-521 keys, but a certificate for one can be stored in
+	// a slot. It must not hide the other slots, nor be offered.
+	d := newFakeDevice(t, 42, map[piv.Slot]string{
+		piv.SlotAuthentication: "p521",
+		piv.SlotSignature:      "p256",
+	})
+	a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}},
+		piv.SlotAuthentication, piv.SlotSignature)
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "YubiKey #42 PIV Slot 9c" {
+		t.Fatalf("got keys %v, want only slot 9c", keys)
+	}
+	_, err = a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0)
+	if !errors.Is(err, errNoMatchingKey) {
+		t.Errorf("got error %v signing with the P-521 key, want errNoMatchingKey", err)
+	}
+
+	d = newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p521"})
+	a = newTestAgent(t, d, &pinPrompter{})
+	if _, err := a.List(); !errors.Is(err, errUnsupportedKey) {
+		t.Errorf("got error %v from a P-521 slot alone, want errUnsupportedKey", err)
+	}
+}
+
+// testPINCache is a PINCache that counts its uses.
+type testPINCache struct {
+	pins       map[uint32]string
+	gets, sets int
+}
+
+func (c *testPINCache) Get(serial uint32) (string, bool) {
+	c.gets++
+	pin, ok := c.pins[serial]
+	return pin, ok
+}
+
+func (c *testPINCache) Set(serial uint32, pin string) {
+	c.sets++
+	c.pins[serial] = pin
+}
+
+func (c *testPINCache) Delete(serial uint32) {
+	delete(c.pins, serial)
+}
+
+func TestNoPINCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		noPINCache  bool
+		cached      bool
+		command     string
+		wantPrompts int
+	}{
+		{name: "cache", cached: true, wantPrompts: 0},
+		{name: "cache disabled", noPINCache: true, cached: true, wantPrompts: 1},
+		{name: "command", command: "echo " + fakePIN, wantPrompts: 0},
+		{name: "command disabled", noPINCache: true, command: "echo " + fakePIN, wantPrompts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+			p := &pinPrompter{pins: []string{fakePIN}}
+			a := newTestAgent(t, d, p)
+			cache := &testPINCache{pins: make(map[uint32]string)}
+			if tt.cached {
+				cache.pins[42] = fakePIN
+			}
+			a.PINCache, a.PINCommand, a.NoPINCache = cache, tt.command, tt.noPINCache
+			if _, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0); err != nil {
+				t.Fatal(err)
+			}
+			if len(p.reqs) != tt.wantPrompts {
+				t.Fatalf("prompted %d times, want %d", len(p.reqs), tt.wantPrompts)
+			}
+			if !tt.noPINCache {
+				return
+			}
+			if !p.reqs[0].NoCache {
+				t.Error("the prompt allowed a cached PIN")
+			}
+			if cache.gets != 0 || cache.sets != 0 {
+				t.Errorf("the cache was used: %d gets, %d sets", cache.gets, cache.sets)
+			}
+		})
+	}
+}
+
+func TestRetriesText(t *testing.T) {
+	tests := []struct {
+		retries int
+		want    string
+	}{
+		{-1, "unknown"},
+		{0, "0"},
+		{1, "1"},
+		{3, "3"},
+	}
+	for _, tt := range tests {
+		req := PINRequest{Serial: 42, Retries: tt.retries}
+		if got := req.RetriesText(); got != tt.want {
+			t.Errorf("RetriesText() with %d retries = %q, want %q", tt.retries, got, tt.want)
+		}
+		desc := message("promptDescription", req)
+		if !strings.Contains(desc, "("+tt.want+" tries remaining)") {
+			t.Errorf("prompt with %d retries says %q", tt.retries, desc)
+		}
+	}
+}
+
+func TestPINCacheRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		noPINCache bool
+		retries    int
+		pinFailed  bool
+		want       bool
+	}{
+		{name: "plenty", retries: 3, want: false},
+		{name: "two", retries: 2, want: false},
+		{name: "last two", retries: 1, want: true},
+		{name: "blocked", retries: 0, want: true},
+		{name: "unknown", retries: -1, want: false},
+		{name: "unknown after a wrong PIN", retries: -1, pinFailed: true, want: true},
+		{name: "known after a wrong PIN", retries: 2, pinFailed: true, want: false},
+		{name: "disabled", noPINCache: true, retries: 3, want: true},
+		{name: "disabled unknown", noPINCache: true, retries: -1, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{NoPINCache: tt.noPINCache, pinFailed: tt.pinFailed}
+			if got := a.noPINCache(tt.retries); got != tt.want {
+				t.Errorf("noPINCache(%d) = %v, want %v", tt.retries, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("prompt", func(t *testing.T) {
+		for _, tt := range []struct {
+			name        string
+			retries     int
+			hideRetries bool
+			wantPrompts int
+		}{
+			{name: "plenty", retries: 3, wantPrompts: 0},
+			{name: "last two", retries: 1, wantPrompts: 1},
+			{name: "unknown", retries: 1, hideRetries: true, wantPrompts: 0},
+		} {
+			d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+			d.retries, d.hideRetries = tt.retries, tt.hideRetries
+			p := &pinPrompter{pins: []string{fakePIN}}
+			a := newTestAgent(t, d, p)
+			a.PINCache = &testPINCache{pins: map[uint32]string{42: fakePIN}}
+			if _, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if len(p.reqs) != tt.wantPrompts {
+				t.Errorf("%s: prompted %d times, want %d", tt.name, len(p.reqs), tt.wantPrompts)
+			}
+			if len(p.reqs) > 0 && (!p.reqs[0].NoCache || p.reqs[0].Retries != tt.retries) {
+				t.Errorf("%s: got prompt %+v", tt.name, p.reqs[0])
+			}
+		}
+	})
+
+	t.Run("wrong cached PIN", func(t *testing.T) {
+		d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+		p := &pinPrompter{}
+		a := newTestAgent(t, d, p)
+		a.PINCache = &testPINCache{pins: map[uint32]string{42: "000000"}}
+		if _, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0); !errors.Is(err, ErrPINCancelled) {
+			t.Fatalf("got error %v, want ErrPINCancelled", err)
+		}
+		if !a.pinFailed {
+			t.Error("pinFailed not set after a wrong PIN")
+		}
+		if len(p.reqs) != 1 || !p.reqs[0].NoCache || !p.reqs[0].WrongPIN {
+			t.Errorf("got prompts %+v, want one after the wrong cached PIN", p.reqs)
+		}
+	})
+}
+
+func TestTouchNotifyDelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		delay        time.Duration
+		touch        time.Duration
+		pinPrompt    time.Duration
+		wantNotified bool
+	}{
+		{name: "cached touch", delay: 300 * time.Millisecond},
+		{name: "touch", delay: 20 * time.Millisecond, touch: 500 * time.Millisecond, wantNotified: true},
+		{name: "slow PIN prompt", delay: 100 * time.Millisecond, pinPrompt: 400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+			d.signHook = func() { time.Sleep(tt.touch) }
+			a := newTestAgent(t, d, &pinPrompter{})
+			a.PINPrompt = func(req PINRequest) (string, bool, error) {
+				time.Sleep(tt.pinPrompt)
+				return fakePIN, false, nil
+			}
+			a.TouchNotifyDelay = tt.delay
+			// touchHint writes to TouchTTY when the notification is shown.
+			a.TouchTTY = filepath.Join(t.TempDir(), "tty")
+			if err := os.WriteFile(a.TouchTTY, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.SignWithFlags(d.publicKey(t, piv.SlotAuthentication), []byte("session"), 0); err != nil {
+				t.Fatal(err)
+			}
+			// Give a notification that should not be shown the time to be.
+			time.Sleep(tt.delay + 100*time.Millisecond)
+			tty, err := os.ReadFile(a.TouchTTY)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if notified := len(tty) > 0; notified != tt.wantNotified {
+				t.Errorf("notified: %v, want %v", notified, tt.wantNotified)
+			}
+		})
+	}
+}
+
+func TestResetDuringSign(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	waiting, touched := make(chan struct{}), make(chan struct{})
+	d.signHook = func() {
+		waiting <- struct{}{}
+		<-touched
+	}
+	p := &pinPrompter{pins: []string{fakePIN, fakePIN}}
+	a := newTestAgent(t, d, p)
+	a.PINCache = newMemoryPINCache(0)
+	key := d.publicKey(t, piv.SlotAuthentication)
+
+	signErr := make(chan error, 1)
+	go func() {
+		_, err := a.SignWithFlags(key, []byte("session"), 0)
+		signErr <- err
+	}()
+	<-waiting
+
+	// Like the SIGHUP handler, which runs in its own goroutine.
+	resetErr := make(chan error, 1)
+	go func() { resetErr <- a.reset() }()
+	select {
+	case <-resetErr:
+		t.Fatal("reset didn't wait for the signature in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(touched)
+	for _, ch := range []chan error{signErr, resetErr} {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("deadlock between reset and a signature")
+		}
+	}
+
+	// The next signature reconnects and asks for the PIN again.
+	d.signHook = nil
+	if _, err := a.SignWithFlags(key, []byte("session"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if d.opens != 2 || len(p.reqs) != 2 {
+		t.Errorf("got %d connections and %d prompts after reset, want 2 and 2", d.opens, len(p.reqs))
+	}
+}
+
+func TestSignerCache(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{
+		piv.SlotAuthentication: "p256",
+		piv.SlotSignature:      "p384",
+	})
+	p := &pinPrompter{pins: []string{fakePIN, fakePIN, fakePIN}}
+	a := newTestAgent(t, d, p, piv.SlotAuthentication, piv.SlotSignature)
+	sign := func(slot piv.Slot) {
+		t.Helper()
+		if _, err := a.SignWithFlags(d.publicKey(t, slot), []byte("session"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(privateKeys, prompts int) {
+		t.Helper()
+		if d.privateKeys != privateKeys || len(p.reqs) != prompts {
+			t.Fatalf("got %d signers prepared and %d prompts, want %d and %d",
+				d.privateKeys, len(p.reqs), privateKeys, prompts)
+		}
+	}
+
+	sign(piv.SlotAuthentication)
+	check(2, 1)
+	sign(piv.SlotSignature)
+	sign(piv.SlotAuthentication)
+	signers, err := a.Signers()
+	if err != nil || len(signers) != 2 {
+		t.Fatalf("got %d signers and error %v, want 2", len(signers), err)
+	}
+	check(2, 1)
+
+	// The cached signers still ask for the PIN when the YubiKey needs it.
+	d.mu.Lock()
+	d.session.verified = false
+	d.mu.Unlock()
+	sign(piv.SlotSignature)
+	check(2, 2)
+
+	// A new connection needs new signers.
+	d.breakSession()
+	sign(piv.SlotAuthentication)
+	check(4, 3)
+}
+
+// captureLog collects the log output for the rest of the test, in the given
+// -log-format.
+func captureLog(t *testing.T, format string) *logBuffer {
+	buf := new(logBuffer)
+	prev := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(format, buf)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
+// logBuffer is a bytes.Buffer that can be read while connections are still
+// logging in the background.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *logBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestJoinSlots(t *testing.T) {
+	tests := []struct {
+		slots []piv.Slot
+		want  string
+	}{
+		{[]piv.Slot{piv.SlotAuthentication}, "9a"},
+		{[]piv.Slot{piv.SlotAuthentication, piv.SlotSignature}, "9a,9c"},
+	}
+	for _, tt := range tests {
+		if got := joinSlots(tt.slots); got != tt.want {
+			t.Errorf("joinSlots(%v) = %q, want %q", tt.slots, got, tt.want)
+		}
+		if slots, err := parseSlots(tt.want); err != nil || !slices.Equal(slots, tt.slots) {
+			t.Errorf("parseSlots(%q) = %v, %v, want %v", tt.want, slots, err, tt.slots)
+		}
+	}
+}
+
+func TestListProblem(t *testing.T) {
+	d := newFakeDevice(t, 42, nil)
+	a := newTestAgent(t, d, &pinPrompter{}, piv.SlotAuthentication, piv.SlotSignature)
+	logs := captureLog(t, "text")
+	list := func(want int, wantLog string) {
+		t.Helper()
+		logs.Reset()
+		// List twice, as each reason is only logged when it changes.
+		for i := 0; i < 2; i++ {
+			keys, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != want {
+				t.Fatalf("got %d keys, want %d", len(keys), want)
+			}
+		}
+		got := logs.String()
+		if wantLog == "" {
+			if strings.Contains(got, "no keys to offer") || strings.Contains(got, "empty") {
+				t.Errorf("logged a problem with keys to offer:\n%s", got)
+			}
+		} else if n := strings.Count(got, wantLog); n != 1 {
+			t.Errorf("logged %q %d times, want once; log:\n%s", wantLog, n, got)
+		}
+	}
+
+	d.unplugged = true
+	list(0, "no YubiKey detected, so there are no keys to offer")
+	d.unplugged = false
+	list(0, `the YubiKey slots are empty, run "yubikey-agent -setup" to create a key serial=42 slots=9a,9c`)
+
+	other := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotSignature: "p256"})
+	d.mu.Lock()
+	d.keys = other.keys
+	d.mu.Unlock()
+	list(1, "")
+
+	d.breakSession()
+	d.unplugged = true
+	list(0, "no YubiKey detected, so there are no keys to offer")
+}
+
+// serveTestConn serves an in-memory connection with a, and returns its client
+// end.
+func serveTestConn(t *testing.T, a *Agent) net.Conn {
+	t.Helper()
+	c, server := net.Pipe()
+	go a.serveConn(server, connPolicy{})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestServeConnGarbage(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}})
+	logs := captureLog(t, "text")
+	key := d.publicKey(t, piv.SlotAuthentication)
+
+	// wellBehaved checks that a new connection is still served as usual.
+	wellBehaved := func() {
+		t.Helper()
+		client := agent.NewClient(serveTestConn(t, a))
+		keys, err := client.List()
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("List = %v, %v; want one key", keys, err)
+		}
+		sig, err := client.Sign(key, []byte("session"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := key.Verify([]byte("session"), sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frame := func(msg []byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...)
+	}
+	wellBehaved()
+
+	tests := []struct {
+		name string
+		send []byte
+		// reply is the expected reply, or nil if the connection is closed.
+		reply []byte
+	}{
+		{"empty request", frame(nil), frame([]byte{agentFailure})},
+		{"unknown type", frame([]byte{200, 1, 2, 3}), frame([]byte{agentFailure})},
+		{"malformed sign request", frame([]byte{agentSignRequest, 0, 0, 0, 42}), frame([]byte{agentFailure})},
+		{"truncated", frame([]byte{agentSignRequest, 0, 0, 0, 42})[:6], nil},
+		{"too large", binary.BigEndian.AppendUint32(nil, maxRequestSize+1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := serveTestConn(t, a)
+			if _, err := c.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+			if tt.reply == nil {
+				c.Close()
+			} else {
+				reply := make([]byte, len(tt.reply))
+				if _, err := io.ReadFull(c, reply); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(reply, tt.reply) {
+					t.Errorf("got reply %x, want %x", reply, tt.reply)
+				}
+			}
+			wellBehaved()
+		})
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		d.mu.Lock()
+		d.signHook = func() { panic("fake YubiKey bug") }
+		d.mu.Unlock()
+		client := agent.NewClient(serveTestConn(t, a))
+		if _, err := client.Sign(key, []byte("session")); err == nil {
+			t.Fatal("Sign succeeded despite the panic")
+		}
+		if !strings.Contains(logs.String(), `panic while serving a request connection=`) ||
+			!strings.Contains(logs.String(), `panic="fake YubiKey bug"`) {
+			t.Errorf("the panic was not logged:\n%s", logs)
+		}
+		d.mu.Lock()
+		d.signHook = nil
+		d.mu.Unlock()
+		wellBehaved()
+	})
+}
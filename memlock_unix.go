@@ -0,0 +1,17 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// lockMemory prevents b from being swapped to disk.
+func lockMemory(b []byte) error {
+	return unix.Mlock(b)
+}
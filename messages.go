@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// defaultMessages are the user-facing strings of the PIN prompts, the
+// confirmation dialogs, and the notifications. They are text/template
+// templates executed with a PINRequest, and can be overridden with
+// loadMessages, for example to localize them.
+//
+// Notifications and confirmations are executed with a PINRequest that has
+// only Serial, Fingerprint, HostKey, Host, PID, and Program set. For
+// touchNotification, Timeout is also set to the time left to touch the
+// YubiKey, if known, and for pinRetriesNotification, Retries is set.
+var defaultMessages = map[string]string{
+	"promptTitle": "yubikey-agent PIN prompt",
+	"promptDescription": "YubiKey serial number: {{ .Serial }} ({{ .RetriesText }} tries remaining)\n\n" +
+		"Key: {{ .Fingerprint }} (slot {{ .Slot }})" +
+		"{{ if .Host }}\nHost: {{ .Host }}{{ end }}" +
+		"{{ if .HostKey }}\nHost key: {{ .HostKey }}{{ end }}",
+	"promptLabel":    "Please enter your PIN:",
+	"promptWrongPIN": "Wrong PIN! Only {{ .Retries }} tries remaining.",
+	"confirmTitle":   "yubikey-agent",
+	"confirmForwarded": "A forwarded agent connection is asking to sign with your YubiKey.\n\n" +
+		"Key: {{ .Fingerprint }}" +
+		"{{ if .Host }}\nHost: {{ .Host }}{{ end }}" +
+		"{{ if .HostKey }}\nHost key: {{ .HostKey }}{{ end }}\n\nAllow it?",
+	"confirmRestricted": "A connection to the restricted agent socket is asking to sign with one of your keys.\n\n" +
+		"Key: {{ .Fingerprint }}" +
+		"{{ if .Program }}\nProgram: {{ .Program }} (pid {{ .PID }}){{ end }}" +
+		"{{ if .Host }}\nHost: {{ .Host }}{{ end }}" +
+		"{{ if .HostKey }}\nHost key: {{ .HostKey }}{{ end }}\n\nAllow it?",
+	"confirmSignature": "A program is asking to sign with your YubiKey.\n\n" +
+		"Key: {{ .Fingerprint }}" +
+		"{{ if .Program }}\nProgram: {{ .Program }} (pid {{ .PID }}){{ end }}" +
+		"{{ if .Host }}\nHost: {{ .Host }}{{ end }}" +
+		"{{ if .HostKey }}\nHost key: {{ .HostKey }}{{ end }}\n\nAllow it?",
+	"confirmRawSign": "A program is asking for a raw signature with your YubiKey, " +
+		"which is not for SSH, and could be used for a certificate, a token, or a release.\n\n" +
+		"Key: {{ .Fingerprint }}" +
+		"{{ if .Program }}\nProgram: {{ .Program }} (pid {{ .PID }}){{ end }}\n\nAllow it?",
+	"confirmAllow": "Allow",
+	"confirmDeny":  "Deny",
+	"touchNotification": "Waiting for YubiKey touch" +
+		"{{ if .Timeout }} ({{ .Timeout.Seconds }}s left){{ end }}...\n" +
+		"Key: {{ .Fingerprint }}" +
+		"{{ if .Host }}\nHost: {{ .Host }}{{ else if .HostKey }}\nHost key: {{ .HostKey }}{{ end }}" +
+		"{{ if .Program }}\nRequested by {{ .Program }} (pid {{ .PID }}){{ end }}",
+	"touchTimeoutNotification": "Touch not received — the SSH attempt failed, retry the command.",
+	"pinRetriesNotification":   "YubiKey #{{ .Serial }}: only {{ .Retries }} PIN attempt(s) remaining!",
+	"pinBlockedNotification": "YubiKey PIN is blocked! Unblock it with the PUK using " +
+		"\"ykman piv access unblock-pin\".",
+}
+
+var messages = mustParseMessages(nil)
+
+func mustParseMessages(overrides map[string]string) *template.Template {
+	t, err := parseMessages(overrides)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func parseMessages(overrides map[string]string) (*template.Template, error) {
+	t := template.New("messages")
+	for name, text := range defaultMessages {
+		if o, ok := overrides[name]; ok {
+			text = o
+		}
+		if _, err := t.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid message %q: %w", name, err)
+		}
+		// Catch references to fields that don't exist now, not at prompt time.
+		if err := t.ExecuteTemplate(io.Discard, name, PINRequest{}); err != nil {
+			return nil, fmt.Errorf("invalid message %q: %w", name, err)
+		}
+	}
+	for name := range overrides {
+		if _, ok := defaultMessages[name]; !ok {
+			return nil, fmt.Errorf("unknown message %q", name)
+		}
+	}
+	return t, nil
+}
+
+// loadMessages replaces the default messages with those in the JSON object in
+// the file at path, if not empty, keyed by the names in defaultMessages, and
+// then with those in overrides. Messages missing from both keep their default.
+func loadMessages(path string, overrides map[string]string) error {
+	all := make(map[string]string)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	for name, text := range overrides {
+		all[name] = text
+	}
+	t, err := parseMessages(all)
+	if err != nil {
+		if path != "" {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return err
+	}
+	messages = t
+	return nil
+}
+
+// message executes the named message with req.
+func message(name string, req PINRequest) string {
+	var b strings.Builder
+	if err := messages.ExecuteTemplate(&b, name, req); err != nil {
+		slog.Error("failed to render a message", "message", name, "error", err)
+		var d strings.Builder
+		template.Must(template.New(name).Parse(defaultMessages[name])).Execute(&d, req)
+		return d.String()
+	}
+	return b.String()
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+// metrics counts what the agent does, for the -metrics-addr server. It has its
+// own lock, so that it can be read while an operation holds Agent.mu, maybe
+// waiting for a touch. The zero value is ready to use.
+type metrics struct {
+	mu sync.Mutex
+
+	signs      map[signLabels]uint64
+	lists      uint64
+	reconnects uint64
+	connected  bool
+
+	// pinPromptCounts[i] counts the prompts answered within
+	// pinPromptBuckets[i] seconds, and the last entry all of them.
+	pinPromptCounts [len(pinPromptBuckets) + 1]uint64
+	pinPromptSum    float64
+}
+
+type signLabels struct {
+	serial  uint32
+	slot    string
+	outcome string
+}
+
+// pinPromptBuckets are the upper bounds of the pin_prompt_seconds histogram.
+var pinPromptBuckets = [...]float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+func (m *metrics) countSign(serial uint32, slot piv.Slot, err error) {
+	outcome := "ok"
+	var authErr piv.AuthErr
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotConfirmed):
+		outcome = "denied"
+	case errors.Is(err, ErrTouchTimeout):
+		outcome = "touch_timeout"
+	case errors.Is(err, ErrPINCancelled), errors.Is(err, ErrPINTimeout),
+		errors.Is(err, ErrPINBlocked), errors.As(err, &authErr):
+		outcome = "pin_error"
+	default:
+		outcome = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.signs == nil {
+		m.signs = make(map[signLabels]uint64)
+	}
+	m.signs[signLabels{serial, slot.String(), outcome}]++
+}
+
+func (m *metrics) countList() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists++
+}
+
+// countConnect counts every connection to the YubiKey but the first as a
+// reconnection.
+func (m *metrics) countConnect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connected {
+		m.reconnects++
+	}
+	m.connected = true
+}
+
+func (m *metrics) observePINPrompt(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := d.Seconds()
+	for i, le := range pinPromptBuckets {
+		if s <= le {
+			m.pinPromptCounts[i]++
+		}
+	}
+	m.pinPromptCounts[len(pinPromptBuckets)]++
+	m.pinPromptSum += s
+}
+
+// writeTo writes the metrics in the Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP yubikey_agent_signs_total Signatures attempted with a YubiKey key, by outcome.")
+	fmt.Fprintln(w, "# TYPE yubikey_agent_signs_total counter")
+	var labels []signLabels
+	for l := range m.signs {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.serial != b.serial {
+			return a.serial < b.serial
+		}
+		if a.slot != b.slot {
+			return a.slot < b.slot
+		}
+		return a.outcome < b.outcome
+	})
+	for _, l := range labels {
+		fmt.Fprintf(w, "yubikey_agent_signs_total{serial=\"%d\",slot=\"%s\",outcome=\"%s\"} %d\n",
+			l.serial, l.slot, l.outcome, m.signs[l])
+	}
+
+	fmt.Fprintln(w, "# HELP yubikey_agent_list_total Requests to list the keys.")
+	fmt.Fprintln(w, "# TYPE yubikey_agent_list_total counter")
+	fmt.Fprintf(w, "yubikey_agent_list_total %d\n", m.lists)
+
+	fmt.Fprintln(w, "# HELP yubikey_agent_card_reconnects_total Connections to the YubiKey after the first one.")
+	fmt.Fprintln(w, "# TYPE yubikey_agent_card_reconnects_total counter")
+	fmt.Fprintf(w, "yubikey_agent_card_reconnects_total %d\n", m.reconnects)
+
+	fmt.Fprintln(w, "# HELP yubikey_agent_pin_prompt_seconds Time the user took to answer PIN prompts.")
+	fmt.Fprintln(w, "# TYPE yubikey_agent_pin_prompt_seconds histogram")
+	for i, le := range pinPromptBuckets {
+		fmt.Fprintf(w, "yubikey_agent_pin_prompt_seconds_bucket{le=\"%g\"} %d\n", le, m.pinPromptCounts[i])
+	}
+	count := m.pinPromptCounts[len(pinPromptBuckets)]
+	fmt.Fprintf(w, "yubikey_agent_pin_prompt_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "yubikey_agent_pin_prompt_seconds_sum %g\n", m.pinPromptSum)
+	fmt.Fprintf(w, "yubikey_agent_pin_prompt_seconds_count %d\n", count)
+}
+
+// serveMetrics serves the metrics of a at http://addr/metrics. addr must be a
+// loopback address, as anyone who can reach it can watch the agent's activity.
+func serveMetrics(addr string, a *Agent) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		a.metrics.writeTo(w)
+	})
+	l, err := serveLoopbackHTTP(addr, mux)
+	if err != nil {
+		return err
+	}
+	a.logInfo("serving metrics", "url", "http://"+l.String()+"/metrics")
+
+	return nil
+}
+
+// serveLoopbackHTTP serves h in the background on the loopback TCP address
+// addr, on a listener of its own, and returns the address it's bound to,
+// which is useful if addr has port 0.
+func serveLoopbackHTTP(addr string, h http.Handler) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("not a loopback address")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			slog.Error("HTTP server failed", "address", l.Addr().String(), "error", err)
+		}
+	}()
+	return l.Addr(), nil
+}
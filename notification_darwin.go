@@ -0,0 +1,59 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+var lastNotificationID atomic.Uint64
+
+// showNotification shows a notification in the Notification Center. sound
+// makes it play an alert sound.
+//
+// If terminal-notifier is installed, it's used so that the notification can be
+// updated, and removed when ctx is done. Otherwise, notifications shown by
+// osascript can't be changed, so ctx is ignored.
+func showNotification(ctx context.Context, message string, sound bool) (update func(string), err error) {
+	if path, err := exec.LookPath("terminal-notifier"); err == nil {
+		group := fmt.Sprintf("yubikey-agent-%d", lastNotificationID.Add(1))
+		args := []string{"-title", "yubikey-agent", "-message", message, "-group", group}
+		if sound {
+			args = append(args, "-sound", "Glass")
+		}
+		if err := exec.Command(path, args...).Run(); err == nil {
+			if ctx.Done() != nil {
+				go func() {
+					<-ctx.Done()
+					exec.Command(path, "-remove", group).Run()
+				}()
+			}
+			// A notification with the same group replaces the previous one.
+			return func(message string) {
+				if ctx.Err() == nil {
+					exec.Command(path, "-title", "yubikey-agent", "-message", message, "-group", group).Run()
+				}
+			}, nil
+		}
+	}
+
+	message = strings.ReplaceAll(message, `\`, `\\`)
+	message = strings.ReplaceAll(message, `"`, `\"`)
+	appleScript := `display notification "%s" with title "yubikey-agent"`
+	if sound {
+		appleScript += ` sound name "Glass"`
+	}
+	if out, err := exec.Command("osascript", "-e", fmt.Sprintf(appleScript, message)).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("osascript failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil, nil
+}
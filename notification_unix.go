@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// showNotification shows a notification through the org.freedesktop.Notifications
+// D-Bus service, and closes it when ctx is done. If the session bus is not
+// available, like on BSDs without a desktop session bus, it falls back to
+// notify-send, the notification lifetime is up to the notification daemon, and
+// it can't be updated. sound is ignored.
+func showNotification(ctx context.Context, message string, sound bool) (update func(string), err error) {
+	if conn, err := dbus.SessionBus(); err == nil {
+		notifications := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+		// Notifications that can't be closed, because ctx is never done, are
+		// warnings that shouldn't expire before the user sees them.
+		expire := int32(-1)
+		if ctx.Done() == nil {
+			expire = 0
+		}
+		notify := func(replaces uint32, message string) (id uint32, err error) {
+			err = notifications.Call("org.freedesktop.Notifications.Notify", 0,
+				"yubikey-agent", replaces, "dialog-password", "yubikey-agent", message,
+				[]string{}, map[string]dbus.Variant{}, expire).Store(&id)
+			return id, err
+		}
+		if id, err := notify(0, message); err == nil {
+			if ctx.Done() != nil {
+				go func() {
+					<-ctx.Done()
+					notifications.Call("org.freedesktop.Notifications.CloseNotification", 0, id)
+				}()
+			}
+			return func(message string) {
+				if ctx.Err() == nil {
+					notify(id, message)
+				}
+			}, nil
+		}
+	}
+	if err := exec.Command("notify-send", "-i", "dialog-password", "yubikey-agent", message).Run(); err != nil {
+		return nil, fmt.Errorf("no notification service on D-Bus, and notify-send failed: %w", err)
+	}
+	return nil, nil
+}
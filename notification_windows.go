@@ -0,0 +1,158 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// toastAppID is the AppUserModelID of PowerShell, which is registered on every
+// system, so toasts can be shown without installing a shortcut for the agent.
+const toastAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+const toastScript = `
+$ErrorActionPreference = "Stop"
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+[Windows.Data.Xml.Dom.XmlDocument, Windows.Data.Xml.Dom.XmlDocument, ContentType = WindowsRuntime] > $null
+$xml = New-Object Windows.Data.Xml.Dom.XmlDocument
+$xml.LoadXml($env:YUBIKEY_AGENT_TOAST)
+$toast = New-Object Windows.UI.Notifications.ToastNotification $xml
+$toast.Tag = $env:YUBIKEY_AGENT_TOAST_TAG
+$toast.Group = "yubikey-agent"
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:YUBIKEY_AGENT_TOAST_APP).Show($toast)
+`
+
+const removeToastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+[Windows.UI.Notifications.ToastNotificationManager]::History.Remove($env:YUBIKEY_AGENT_TOAST_TAG, "yubikey-agent", $env:YUBIKEY_AGENT_TOAST_APP)
+`
+
+// balloonScript shows a tray balloon until its standard input is closed.
+const balloonScript = `
+Add-Type -AssemblyName System.Windows.Forms
+$icon = New-Object System.Windows.Forms.NotifyIcon
+$icon.Icon = [System.Drawing.SystemIcons]::Information
+$icon.Text = "yubikey-agent"
+$icon.Visible = $true
+$icon.ShowBalloonTip(30000, "yubikey-agent", $env:YUBIKEY_AGENT_NOTIFICATION, "Info")
+[Console]::In.ReadToEnd() > $null
+$icon.Dispose()
+`
+
+// balloonTimeout is how long a tray balloon is kept if ctx is never done.
+const balloonTimeout = 30 * time.Second
+
+var lastToastID atomic.Uint64
+
+// showNotification shows a toast notification, falling back to a tray balloon
+// on systems without toasts. Either is removed when ctx is done. sound makes
+// the toast play the default notification sound. Only toasts can be updated.
+func showNotification(ctx context.Context, message string, sound bool) (update func(string), err error) {
+	tag := fmt.Sprintf("notification-%d", lastToastID.Add(1))
+	show := func(message string, sound bool) error {
+		return runPowerShell(toastScript,
+			"YUBIKEY_AGENT_TOAST="+toastXML(message, sound),
+			"YUBIKEY_AGENT_TOAST_TAG="+tag,
+			"YUBIKEY_AGENT_TOAST_APP="+toastAppID)
+	}
+	if err := show(message, sound); err != nil {
+		slog.Warn("failed to show a toast notification, using a tray balloon", "error", err)
+		if err := showBalloon(ctx, message); err != nil {
+			return nil, fmt.Errorf("failed to show a tray balloon: %w", err)
+		}
+		return nil, nil
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			runPowerShell(removeToastScript,
+				"YUBIKEY_AGENT_TOAST_TAG="+tag,
+				"YUBIKEY_AGENT_TOAST_APP="+toastAppID)
+		}()
+	}
+	// A toast with the same tag and group replaces the previous one.
+	return func(message string) {
+		if ctx.Err() == nil {
+			show(message, false)
+		}
+	}, nil
+}
+
+func toastXML(message string, sound bool) string {
+	var text bytes.Buffer
+	xml.EscapeText(&text, []byte(message))
+	audio := `<audio silent="true"/>`
+	if sound {
+		audio = ""
+	}
+	return `<toast><visual><binding template="ToastGeneric">` +
+		`<text>yubikey-agent</text><text>` + text.String() + `</text>` +
+		`</binding></visual>` + audio + `</toast>`
+}
+
+func showBalloon(ctx context.Context, message string) error {
+	cmd := powerShell(balloonScript, "YUBIKEY_AGENT_NOTIFICATION="+message)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		t := time.NewTimer(balloonTimeout)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+		stdin.Close()
+		cmd.Wait()
+	}()
+	return nil
+}
+
+func runPowerShell(script string, env ...string) error {
+	cmd := powerShell(script, env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// powerShell returns a command running script in a hidden PowerShell, with
+// the given additional environment variables, which are used to pass values
+// to the script without having to escape them.
+func powerShell(script string, env ...string) *exec.Cmd {
+	// -EncodedCommand takes the script as base64 of UTF-16LE, and leaves
+	// standard input free for the script to use.
+	utf16 := windows.StringToUTF16(script)
+	encoded := make([]byte, 0, len(utf16)*2)
+	for _, c := range utf16[:len(utf16)-1] {
+		encoded = append(encoded, byte(c), byte(c>>8))
+	}
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive",
+		"-WindowStyle", "Hidden", "-EncodedCommand", base64.StdEncoding.EncodeToString(encoded))
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: windows.CREATE_NO_WINDOW,
+	}
+	return cmd
+}
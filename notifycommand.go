@@ -0,0 +1,53 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// notifyCommandTimeout is how long a -notify-command program can run before
+// it's killed.
+const notifyCommandTimeout = 10 * time.Second
+
+// runNotifyCommand runs program in the background with message as its only
+// argument, logging its failures. The event, like "touch-start", and the
+// details of req are passed in environment variables.
+func runNotifyCommand(program, event, message string, req PINRequest) {
+	go func() {
+		if err := execNotifyCommand(program, event, message, req); err != nil {
+			slog.Error("notification command failed", "event", event, "error", err)
+		}
+	}()
+}
+
+// execNotifyCommand is like runNotifyCommand, but waits for program to exit,
+// and returns its failure along with its output.
+func execNotifyCommand(program, event, message string, req PINRequest) error {
+	env := append(os.Environ(),
+		"YUBIKEY_AGENT_EVENT="+event,
+		fmt.Sprintf("YUBIKEY_AGENT_SERIAL=%d", req.Serial),
+		"YUBIKEY_AGENT_FINGERPRINT="+req.Fingerprint,
+		"YUBIKEY_AGENT_HOST_KEY="+req.HostKey,
+		fmt.Sprintf("YUBIKEY_AGENT_PID=%d", req.PID),
+		"YUBIKEY_AGENT_PROGRAM="+req.Program,
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), notifyCommandTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, program, message)
+	c.Env = env
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNotifyCommand writes a -notify-command program that runs body, and
+// returns its path.
+func fakeNotifyCommand(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecNotifyCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := fakeNotifyCommand(t, `echo "$YUBIKEY_AGENT_EVENT $YUBIKEY_AGENT_SERIAL $1" > `+out)
+	if err := execNotifyCommand(cmd, "touch-start", "Touch", PINRequest{Serial: 42}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "touch-start 42 Touch\n"; string(got) != want {
+		t.Errorf("the command got %q, want %q", got, want)
+	}
+}
+
+func TestRunTestNotifyFailure(t *testing.T) {
+	cmd := fakeNotifyCommand(t, "echo 'no notification daemon' >&2; exit 1")
+	err := runTestNotify(&Agent{NotifyCommand: cmd})
+	if err == nil {
+		t.Fatal("runTestNotify succeeded with a failing -notify-command")
+	}
+	if !strings.Contains(err.Error(), "test-start") || !strings.Contains(err.Error(), "no notification daemon") {
+		t.Errorf("the error doesn't name the event and the output: %v", err)
+	}
+
+	if err := runTestNotify(&Agent{NoNotify: true, NotifyCommand: cmd}); err != nil {
+		t.Errorf("runTestNotify with NoNotify failed: %v", err)
+	}
+}
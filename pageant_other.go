@@ -0,0 +1,16 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+func startPageant(a *Agent) error {
+	return errors.New("Pageant emulation is only supported on Windows")
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	moduser32   = windows.NewLazySystemDLL("user32.dll")
+	modkernel32 = windows.NewLazySystemDLL("kernel32.dll")
+
+	procRegisterClassExW = moduser32.NewProc("RegisterClassExW")
+	procCreateWindowExW  = moduser32.NewProc("CreateWindowExW")
+	procDefWindowProcW   = moduser32.NewProc("DefWindowProcW")
+	procFindWindowW      = moduser32.NewProc("FindWindowW")
+	procGetMessageW      = moduser32.NewProc("GetMessageW")
+	procTranslateMessage = moduser32.NewProc("TranslateMessage")
+	procDispatchMessageW = moduser32.NewProc("DispatchMessageW")
+	procOpenFileMappingW = modkernel32.NewProc("OpenFileMappingW")
+)
+
+const (
+	wmCopyData = 0x004A
+
+	// pageantCopyDataID is the dwData of the WM_COPYDATA messages sent by
+	// PuTTY-family clients, whose lpData is the name of a file mapping
+	// holding the request, to be overwritten with the response.
+	pageantCopyDataID = 0x804e50ba
+
+	// pageantMaxMessage is the size of the file mapping, AGENT_MAX_MSGLEN.
+	pageantMaxMessage = 8192
+)
+
+// wndClassEx is WNDCLASSEXW.
+type wndClassEx struct {
+	size       uint32
+	style      uint32
+	wndProc    uintptr
+	clsExtra   int32
+	wndExtra   int32
+	instance   windows.Handle
+	icon       windows.Handle
+	cursor     windows.Handle
+	background windows.Handle
+	menuName   *uint16
+	className  *uint16
+	iconSm     windows.Handle
+}
+
+// copyDataStruct is COPYDATASTRUCT.
+type copyDataStruct struct {
+	data uintptr
+	size uint32
+	ptr  *byte
+}
+
+// msg is MSG.
+type msg struct {
+	hwnd    windows.HWND
+	message uint32
+	wParam  uintptr
+	lParam  uintptr
+	time    uint32
+	pt      struct{ x, y int32 }
+}
+
+// startPageant creates the hidden window PuTTY, WinSCP, and FileZilla look
+// for to talk to Pageant, and serves their requests with a. It fails if a
+// Pageant is already running.
+func startPageant(a *Agent) error {
+	errCh := make(chan error)
+	go func() {
+		// Window messages are delivered to the thread that created the window.
+		runtime.LockOSThread()
+		name := windows.StringToUTF16Ptr("Pageant")
+		if hwnd, _, _ := procFindWindowW.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name))); hwnd != 0 {
+			errCh <- errors.New("Pageant is already running, close it to let yubikey-agent take its place")
+			return
+		}
+		wc := wndClassEx{
+			wndProc: windows.NewCallback(func(hwnd windows.HWND, message uint32, wParam, lParam uintptr) uintptr {
+				if message == wmCopyData {
+					// lParam points to a COPYDATASTRUCT owned by the sender.
+					return a.pageantRequest(*(**copyDataStruct)(unsafe.Pointer(&lParam)))
+				}
+				r, _, _ := procDefWindowProcW.Call(uintptr(hwnd), uintptr(message), wParam, lParam)
+				return r
+			}),
+			className: name,
+		}
+		wc.size = uint32(unsafe.Sizeof(wc))
+		if r, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&wc))); r == 0 {
+			errCh <- fmt.Errorf("failed to register the Pageant window class: %w", err)
+			return
+		}
+		hwnd, _, err := procCreateWindowExW.Call(0, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(name)),
+			0, 0, 0, 0, 0, 0, 0, 0, 0)
+		if hwnd == 0 {
+			errCh <- fmt.Errorf("failed to create the Pageant window: %w", err)
+			return
+		}
+		errCh <- nil
+		var m msg
+		for {
+			if r, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&m)), 0, 0, 0); int32(r) <= 0 {
+				return
+			}
+			procTranslateMessage.Call(uintptr(unsafe.Pointer(&m)))
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&m)))
+		}
+	}()
+	return <-errCh
+}
+
+// pageantRequest handles a WM_COPYDATA message, returning 1 if the response
+// was written to the file mapping, and 0 otherwise.
+func (a *Agent) pageantRequest(cds *copyDataStruct) uintptr {
+	if cds.data != pageantCopyDataID || cds.size == 0 {
+		return 0
+	}
+	name := unsafe.Slice(cds.ptr, cds.size)
+	name, _, _ = bytes.Cut(name, []byte{0})
+	namePtr, err := windows.UTF16PtrFromString(string(name))
+	if err != nil {
+		return 0
+	}
+	h, _, err := procOpenFileMappingW.Call(windows.FILE_MAP_WRITE, 0, uintptr(unsafe.Pointer(namePtr)))
+	if h == 0 {
+		slog.Error("failed to open the Pageant request", "error", err)
+		return 0
+	}
+	mapping := windows.Handle(h)
+	defer windows.CloseHandle(mapping)
+
+	// Only serve requests from processes of the same user, like the agent
+	// socket does.
+	if err := checkMappingOwner(mapping); err != nil {
+		slog.Warn("rejected Pageant request", "error", err)
+		return 0
+	}
+
+	addr, err := windows.MapViewOfFile(mapping, windows.FILE_MAP_WRITE, 0, 0, 0)
+	if err != nil {
+		slog.Error("failed to map the Pageant request", "error", err)
+		return 0
+	}
+	defer windows.UnmapViewOfFile(addr)
+	buf := unsafe.Slice(*(**byte)(unsafe.Pointer(&addr)), pageantMaxMessage)
+
+	n := binary.BigEndian.Uint32(buf)
+	if n > pageantMaxMessage-4 {
+		return 0
+	}
+	var res bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(buf[:4+n]), &res}
+	cl := &client{Agent: a, id: lastClientID.Add(1)}
+	defer cl.closeUpstream()
+	a.logInfo("connection from a Pageant client", "event", "connection", "connection", cl.id)
+	if err := agent.ServeAgent(cl, rw); err != io.EOF {
+		slog.Error("connection ended with error", "connection", cl.id, "error", err)
+
+	}
+	if res.Len() == 0 || res.Len() > pageantMaxMessage {
+		return 0
+	}
+	copy(buf, res.Bytes())
+	return 1
+}
+
+func checkMappingOwner(mapping windows.Handle) error {
+	sd, err := windows.GetSecurityInfo(mapping, windows.SE_KERNEL_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return err
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return err
+	}
+	if !owner.Equals(user.User.Sid) {
+		return fmt.Errorf("request owned by %v, not the current user", owner)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// peerCred describes the process on the other end of an agent connection.
+type peerCred struct {
+	UID int
+	// PID is zero and Exe is empty if not known.
+	PID int
+	Exe string
+}
+
+func (p peerCred) String() string {
+	s := fmt.Sprintf("uid %d", p.UID)
+	if p.PID != 0 {
+		s += fmt.Sprintf(", pid %d", p.PID)
+	}
+	if p.Exe != "" {
+		s += ", " + p.Exe
+	}
+	return s
+}
+
+// errPeerCredUnsupported is returned by peerCredentials on platforms where the
+// peer of a UNIX socket can't be identified, and for connections that are not
+// UNIX sockets, like in-memory pipes, which only the listener can protect.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported on this platform")
+
+// controlFD calls f with the file descriptor of the UNIX connection c.
+func controlFD(c net.Conn, f func(fd int) error) error {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("%w: not a UNIX connection: %T", errPeerCredUnsupported, c)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fErr error
+	if err := raw.Control(func(fd uintptr) { fErr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return fErr
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials identifies the process on the other end of c, from the
+// LOCAL_PEERCRED and LOCAL_PEERPID of the socket.
+func peerCredentials(c net.Conn) (peerCred, error) {
+	var cred *unix.Xucred
+	var pid int
+	if err := controlFD(c, func(fd int) (err error) {
+		cred, err = unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if err != nil {
+			return err
+		}
+		pid, err = unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+		return err
+	}); err != nil {
+		return peerCred{}, err
+	}
+	return peerCred{UID: int(cred.Uid), PID: pid, Exe: processPath(pid)}, nil
+}
+
+// processPath returns the executable of the process with the given pid, from
+// kern.procargs2, which starts with argc as a 32-bit integer followed by the
+// NUL-terminated path. It returns an empty string if it can't be read.
+func processPath(pid int) string {
+	args, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil || len(args) < 4 {
+		return ""
+	}
+	path, _, _ := bytes.Cut(args[4:], []byte{0})
+	return string(path)
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials identifies the user on the other end of c, from the
+// LOCAL_PEERCRED of the socket. The process is not known.
+func peerCredentials(c net.Conn) (peerCred, error) {
+	var cred *unix.Xucred
+	if err := controlFD(c, func(fd int) (err error) {
+		cred, err = unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		return err
+	}); err != nil {
+		return peerCred{}, err
+	}
+	return peerCred{UID: int(cred.Uid)}, nil
+}
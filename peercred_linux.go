@@ -0,0 +1,30 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials identifies the process on the other end of c, from the
+// SO_PEERCRED of the socket. The executable can only be read for processes of
+// the same user.
+func peerCredentials(c net.Conn) (peerCred, error) {
+	var cred *unix.Ucred
+	if err := controlFD(c, func(fd int) (err error) {
+		cred, err = unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+		return err
+	}); err != nil {
+		return peerCred{}, err
+	}
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.Pid))
+	return peerCred{UID: int(cred.Uid), PID: int(cred.Pid), Exe: exe}, nil
+}
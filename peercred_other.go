@@ -0,0 +1,16 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "net"
+
+func peerCredentials(c net.Conn) (peerCred, error) {
+	return peerCred{}, errPeerCredUnsupported
+}
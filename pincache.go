@@ -0,0 +1,127 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A PINCache stores YubiKey PINs by serial number, for reuse across
+// operations without prompting the user.
+//
+// Implementations must be safe for concurrent use, and should degrade to a
+// cache that holds nothing rather than fail, as the PIN can always be asked
+// for again.
+type PINCache interface {
+	Get(serial uint32) (pin string, ok bool)
+	Set(serial uint32, pin string)
+	Delete(serial uint32)
+}
+
+// keyringService and keyringAccount name the entries that hold PINs in the OS
+// credential stores, like the Secret Service and the Windows Credential
+// Manager.
+const keyringService = "yubikey-agent"
+
+func keyringAccount(serial uint32) string {
+	return fmt.Sprintf("YubiKey #%d", serial)
+}
+
+// memoryPINCache is a PINCache that holds the PIN of a single YubiKey in the
+// agent memory for up to ttl, or indefinitely if ttl is zero. The PIN is kept
+// in a buffer locked out of swap, and zeroed when forgotten.
+type memoryPINCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	buf    []byte
+	pin    []byte // a prefix of buf, or nil
+	serial uint32
+	timer  *time.Timer
+}
+
+// maxPINLength is the longest PIN a YubiKey accepts.
+const maxPINLength = 8
+
+func newMemoryPINCache(ttl time.Duration) PINCache {
+	c := &memoryPINCache{ttl: ttl, buf: make([]byte, maxPINLength)}
+	if err := lockMemory(c.buf); err != nil {
+		slog.Warn("failed to lock the PIN cache memory, it might be swapped to disk", "error", err)
+	}
+	return c
+}
+
+// Get returns a copy of the PIN as a string, which unlike the buffer is not
+// locked out of swap nor zeroed, as that's what piv-go takes.
+func (c *memoryPINCache) Get(serial uint32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pin == nil {
+		return "", false
+	}
+	if c.serial != serial {
+		// A different YubiKey was plugged in.
+		c.clear()
+		return "", false
+	}
+	return string(c.pin), true
+}
+
+func (c *memoryPINCache) Set(serial uint32, pin string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	if len(pin) > len(c.buf) {
+		return
+	}
+	c.pin = c.buf[:copy(c.buf, pin)]
+	c.serial = serial
+	if c.ttl > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(c.ttl, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			// The PIN might have been replaced while this waited for the
+			// lock, and then it's not this timer's to clear.
+			if c.timer == t {
+				c.clear()
+			}
+		})
+		c.timer = t
+	}
+}
+
+// Delete discards the PIN if it's the one of serial. A PIN of another YubiKey
+// is left alone, for example if a lifetime set for the previous one ends.
+func (c *memoryPINCache) Delete(serial uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pin != nil && c.serial == serial {
+		c.clear()
+	}
+}
+
+// forget zeroes the PIN, whichever YubiKey it's for.
+func (c *memoryPINCache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+}
+
+func (c *memoryPINCache) clear() {
+	for i := range c.buf {
+		c.buf[i] = 0
+	}
+	c.pin = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/sys/unix"
+)
+
+// secretServiceCache is a PINCache backed by the D-Bus Secret Service API,
+// as implemented by gnome-keyring and KWallet.
+type secretServiceCache struct {
+	mu sync.Mutex
+	// broken is set after the Secret Service fails, for example because no
+	// daemon is running, to stop trying (and logging) on every operation.
+	broken bool
+}
+
+func newSecretServiceCache() (PINCache, error) {
+	return &secretServiceCache{}, nil
+}
+
+func (c *secretServiceCache) fail(err error) {
+	slog.Warn("Secret Service unavailable, not saving or reading the PIN", "error", err)
+	c.broken = true
+}
+
+func (c *secretServiceCache) Get(serial uint32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return "", false
+	}
+	pin, err := keyring.Get(keyringService, keyringAccount(serial))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", false
+	}
+	if err != nil {
+		c.fail(err)
+		return "", false
+	}
+	return pin, true
+}
+
+func (c *secretServiceCache) Set(serial uint32, pin string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return
+	}
+	if err := keyring.Set(keyringService, keyringAccount(serial), pin); err != nil {
+		c.fail(err)
+	}
+}
+
+func (c *secretServiceCache) Delete(serial uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return
+	}
+	err := keyring.Delete(keyringService, keyringAccount(serial))
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		c.fail(err)
+	}
+}
+
+// kernelKeyringCache is a PINCache backed by the Linux kernel session keyring,
+// for machines without a Secret Service daemon. Entries expire after ttl.
+//
+// Unlike the user keyring, which every process of the user can reach from any
+// session, and which outlives logouts, the session keyring is only shared by
+// the processes of the session the agent was started from.
+type kernelKeyringCache struct {
+	ttl time.Duration
+}
+
+func newKernelKeyringCache(ttl time.Duration) (PINCache, error) {
+	if _, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_SESSION_KEYRING, true); err != nil {
+		return nil, fmt.Errorf("kernel keyring unavailable: %w", err)
+	}
+	return &kernelKeyringCache{ttl: ttl}, nil
+}
+
+const kernelKeyPrefix = "yubikey-agent-pin-"
+
+func kernelKeyDescription(serial uint32) string {
+	return fmt.Sprintf("%s%d", kernelKeyPrefix, serial)
+}
+
+// kernelKeyPerm only lets the possessor, that is a process that shares the
+// session keyring, use the key. Other processes of the user can't even see it.
+const kernelKeyPerm = 0x3f000000
+
+func (c *kernelKeyringCache) Get(serial uint32) (string, bool) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", kernelKeyDescription(serial), 0)
+	if err != nil {
+		// ENOKEY, or EKEYEXPIRED once the TTL passed.
+		return "", false
+	}
+	buf := make([]byte, 64)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil || n > len(buf) {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func (c *kernelKeyringCache) Set(serial uint32, pin string) {
+	id, err := unix.AddKey("user", kernelKeyDescription(serial), []byte(pin), unix.KEY_SPEC_SESSION_KEYRING)
+	if err != nil {
+		slog.Error("failed to cache the PIN in the kernel keyring", "serial", serial, "error", err)
+		return
+	}
+	if err := unix.KeyctlSetperm(id, kernelKeyPerm); err != nil {
+		slog.Error("failed to set the permissions of the cached PIN, discarding it", "serial", serial, "error", err)
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+		return
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(c.ttl/time.Second), 0, 0); err != nil {
+		slog.Error("failed to set the expiration of the cached PIN, discarding it", "serial", serial, "error", err)
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	}
+}
+
+func (c *kernelKeyringCache) Delete(serial uint32) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", kernelKeyDescription(serial), 0)
+	if err != nil {
+		return
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+		slog.Error("failed to discard the PIN cached in the kernel keyring", "serial", serial, "error", err)
+	}
+}
+
+// forgetKernelKeyringPINs discards the PINs of all YubiKeys cached in the
+// session keyring, and returns how many there were. Like the agent, it can
+// only reach the keyring of its own session.
+func forgetKernelKeyringPINs() (int, error) {
+	keyring, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_SESSION_KEYRING, false)
+	if err != nil {
+		// ENOKEY if the session has no keyring, so no PINs.
+		return 0, nil
+	}
+	// Reading a keyring returns the IDs of the keys linked to it.
+	buf := make([]byte, 4096)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, keyring, buf, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the session keyring: %w", err)
+	}
+	if n > len(buf) {
+		buf = make([]byte, n)
+		if n, err = unix.KeyctlBuffer(unix.KEYCTL_READ, keyring, buf, 0); err != nil {
+			return 0, fmt.Errorf("failed to read the session keyring: %w", err)
+		}
+	}
+	var forgotten int
+	for i := 0; i+4 <= n && i+4 <= len(buf); i += 4 {
+		id := int(int32(binary.NativeEndian.Uint32(buf[i:])))
+		// TYPE;UID;GID;PERM;DESCRIPTION
+		desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		if err != nil {
+			continue
+		}
+		fields := strings.SplitN(desc, ";", 5)
+		if len(fields) < 5 || fields[0] != "user" ||
+			!strings.HasPrefix(fields[4], kernelKeyPrefix) {
+			continue
+		}
+		if _, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0); err != nil {
+			return forgotten, fmt.Errorf("failed to discard key %d: %w", id, err)
+		}
+		forgotten++
+	}
+	return forgotten, nil
+}
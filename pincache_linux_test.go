@@ -0,0 +1,70 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKernelKeyringCache(t *testing.T) {
+	// Run in a new session keyring, so as not to touch the PINs cached in the
+	// one of the user. Keyrings belong to the thread, which is locked and then
+	// discarded when the test returns without unlocking it.
+	runtime.LockOSThread()
+	if _, err := unix.KeyctlJoinSessionKeyring(fmt.Sprintf("yubikey-agent-test-%d", os.Getpid())); err != nil {
+		t.Skip("kernel keyring unavailable:", err)
+	}
+	c, err := newKernelKeyringCache(time.Minute)
+	if err != nil {
+		t.Skip(err)
+	}
+	const serial = 42
+
+	c.Set(serial, "123456")
+	if pin, ok := c.Get(serial); !ok || pin != "123456" {
+		t.Fatalf("got %q, %v, want the PIN", pin, ok)
+	}
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", kernelKeyDescription(serial), 0)
+	if err != nil {
+		t.Fatalf("the PIN is not in the session keyring: %v", err)
+	}
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TYPE;UID;GID;PERM;DESCRIPTION, with only possessor permissions.
+	if fields := strings.Split(desc, ";"); len(fields) < 5 || fields[3] != "3f000000" {
+		t.Errorf("got key %q, want permissions 3f000000", desc)
+	}
+	if _, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", kernelKeyDescription(serial), 0); err == nil {
+		t.Error("the PIN is in the user keyring")
+	}
+
+	c.Delete(serial)
+	if _, ok := c.Get(serial); ok {
+		t.Fatal("got a deleted PIN")
+	}
+
+	c.Set(serial, "123456")
+	n, err := forgetKernelKeyringPINs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("forgot %d PINs, want 1", n)
+	}
+	if _, ok := c.Get(serial); ok {
+		t.Fatal("got a PIN discarded by forgetKernelKeyringPINs")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func newSecretServiceCache() (PINCache, error) {
+	return nil, errors.New("the Secret Service is only supported on Linux")
+}
+
+func newKernelKeyringCache(ttl time.Duration) (PINCache, error) {
+	return nil, errors.New("the kernel keyring is only supported on Linux")
+}
+
+func forgetKernelKeyringPINs() (int, error) {
+	return 0, errors.New("the kernel keyring is only supported on Linux")
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryPINCache(t *testing.T) {
+	c := newMemoryPINCache(0).(*memoryPINCache)
+	if _, ok := c.Get(42); ok {
+		t.Fatal("empty cache returned a PIN")
+	}
+	c.Set(42, "123456")
+	if pin, ok := c.Get(42); !ok || pin != "123456" {
+		t.Fatalf("got %q, %v, want the PIN", pin, ok)
+	}
+	if _, ok := c.Get(43); ok {
+		t.Fatal("got the PIN of another YubiKey")
+	}
+	if _, ok := c.Get(42); ok {
+		t.Fatal("the PIN survived another YubiKey being seen")
+	}
+	c.Set(42, "123456789")
+	if _, ok := c.Get(42); ok {
+		t.Fatal("stored a PIN longer than maxPINLength")
+	}
+	c.Set(42, "123456")
+	c.Delete(42)
+	if _, ok := c.Get(42); ok {
+		t.Fatal("got a deleted PIN")
+	}
+	for _, b := range c.buf {
+		if b != 0 {
+			t.Fatal("the PIN buffer was not zeroed")
+		}
+	}
+}
+
+func TestMemoryPINCacheDeleteOtherSerial(t *testing.T) {
+	c := newMemoryPINCache(0).(*memoryPINCache)
+	c.Set(42, "123456")
+	// Like the ssh-add lifetime of the PIN of a YubiKey that was swapped for
+	// another one since, whose PIN was then cached.
+	c.Set(43, "654321")
+	c.Delete(42)
+	if pin, ok := c.Get(43); !ok || pin != "654321" {
+		t.Fatalf("got %q, %v, want the PIN of the other YubiKey", pin, ok)
+	}
+	c.Delete(43)
+	if _, ok := c.Get(43); ok {
+		t.Fatal("got a deleted PIN")
+	}
+
+	c.Set(43, "654321")
+	c.forget()
+	if _, ok := c.Get(43); ok {
+		t.Fatal("got a forgotten PIN")
+	}
+}
+
+func TestMemoryPINCacheTTL(t *testing.T) {
+	c := newMemoryPINCache(50 * time.Millisecond).(*memoryPINCache)
+	c.Set(42, "123456")
+	first := c.timer
+	// Replacing the PIN must leave it to the new timer, even if the first
+	// one already fired and is waiting for the lock.
+	c.mu.Lock()
+	time.Sleep(100 * time.Millisecond)
+	c.mu.Unlock()
+	c.Set(42, "654321")
+	if c.timer == first {
+		t.Fatal("Set didn't replace the timer")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if pin, ok := c.Get(42); !ok || pin != "654321" {
+		t.Fatalf("got %q, %v, want the new PIN", pin, ok)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := c.Get(42); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the PIN didn't expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
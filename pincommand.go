@@ -0,0 +1,92 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// runPINCommand runs the shell command line cmd, like "pass show yubikey",
+// and returns its output as the PIN. The command can tell YubiKeys apart by
+// the YUBIKEY_AGENT_SERIAL environment variable.
+func runPINCommand(cmd string, req PINRequest) (string, error) {
+	ctx := context.Background()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/C", cmd)
+	} else {
+		c = exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+	}
+	c.Env = append(os.Environ(),
+		fmt.Sprintf("YUBIKEY_AGENT_SERIAL=%d", req.Serial),
+		fmt.Sprintf("YUBIKEY_AGENT_PIN_RETRIES=%d", req.Retries),
+	)
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	pin := strings.TrimSpace(string(out))
+	if pin == "" {
+		return "", errors.New("empty output")
+	}
+	return pin, nil
+}
+
+// readPINFD reads the PIN from the file descriptor fd, like gpg
+// --passphrase-fd, up to the end of the file or the first newline, and closes
+// it. The read buffer is zeroed, but the returned string can't be.
+func readPINFD(fd int) (string, error) {
+	f := os.NewFile(uintptr(fd), "pin-fd")
+	if f == nil {
+		return "", fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	buf := make([]byte, 256)
+	defer func() {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}()
+	var n int
+	for n < len(buf) {
+		m, err := f.Read(buf[n:])
+		n += m
+		if bytes.IndexByte(buf[:n], '\n') >= 0 || err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return "", errors.New("empty PIN")
+	}
+	if len(line) > maxPINLength {
+		return "", errors.New("PIN too long")
+	}
+	return string(line), nil
+}
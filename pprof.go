@@ -0,0 +1,36 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+)
+
+// serveDebug serves the net/http/pprof profiles at http://addr/debug/pprof/,
+// so that reporters of performance issues can capture a profile of the
+// installed binary, with something like
+//
+//	go tool pprof http://127.0.0.1:PORT/debug/pprof/profile?seconds=30
+//
+// addr must be a loopback address, and the bound port is logged, as it's
+// likely to be 0 to pick a free one.
+func serveDebug(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	l, err := serveLoopbackHTTP(addr, mux)
+	if err != nil {
+		return err
+	}
+	slog.Info("serving profiles", "url", "http://"+l.String()+"/debug/pprof/")
+	return nil
+}
@@ -12,27 +12,100 @@ import (
 	"fmt"
 	"os/exec"
 	"text/template"
+	"time"
 )
 
 var scriptTemplate = template.Must(template.New("script").Parse(`
 var app = Application.currentApplication()
 app.includeStandardAdditions = true
-app.displayDialog(
-	"YubiKey serial number: {{ .Serial }} " +
-	"({{ .Tries }} tries remaining)\n\n" +
-	"Please enter your PIN:", {
+app.displayDialog("{{ js .Text }}", {
     defaultAnswer: "",
-	withTitle: "yubikey-agent PIN prompt",
+	withTitle: "{{ js .Title }}",
     buttons: ["Cancel", "OK"],
     defaultButton: "OK",
 	cancelButton: "Cancel",
     hiddenAnswer: true,
+	{{- if .Timeout }}
+	givingUpAfter: {{ .Timeout.Seconds }},
+	{{- end }}
 })`))
 
-func getPIN(serial uint32, retries int) (string, error) {
+var confirmTemplate = template.Must(template.New("confirm").Parse(`
+var app = Application.currentApplication()
+app.includeStandardAdditions = true
+app.displayDialog("{{ js .Text }}", {
+	withTitle: "{{ js .Title }}",
+    buttons: ["{{ js .Deny }}", "{{ js .Allow }}"],
+    defaultButton: "{{ js .Deny }}",
+	cancelButton: "{{ js .Deny }}",
+	{{- if .Timeout }}
+	givingUpAfter: {{ .Timeout.Seconds }},
+	{{- end }}
+})`))
+
+type dialog struct {
+	Title, Text string
+	Allow, Deny string
+	Timeout     time.Duration
+}
+
+// confirm asks the user to allow an operation described by desc. Dismissing
+// the dialog or letting it time out counts as denying it.
+func confirm(desc string, timeout time.Duration) (bool, error) {
+	d := dialog{
+		Title:   message("confirmTitle", PINRequest{}),
+		Text:    desc,
+		Allow:   message("confirmAllow", PINRequest{}),
+		Deny:    message("confirmDeny", PINRequest{}),
+		Timeout: timeout,
+	}
+	script := new(bytes.Buffer)
+	if err := confirmTemplate.Execute(script, d); err != nil {
+		return false, err
+	}
+
+	c := exec.Command("osascript", "-s", "se", "-l", "JavaScript")
+	c.Stdin = script
+	out, err := c.Output()
+	if err, ok := err.(*exec.ExitError); ok && bytes.Contains(err.Stderr, []byte("(-128)")) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to execute osascript: %v", err)
+	}
+	var x struct {
+		Button string `json:"buttonReturned"`
+		GaveUp bool   `json:"gaveUp"`
+	}
+	if err := json.Unmarshal(out, &x); err != nil {
+		return false, fmt.Errorf("failed to parse osascript output: %v", err)
+	}
+	return x.Button == d.Allow && !x.GaveUp, nil
+}
+
+func getPIN(req PINRequest) (pin string, fromCache bool, err error) {
+	pin, err = runPINDialog(req)
+	return pin, false, err
+}
+
+// pinAccepted is a no-op, as the osascript dialog doesn't cache PINs.
+func pinAccepted(serial uint32, pin string) {}
+
+// forgetCachedPIN is a no-op, as the osascript dialog doesn't cache PINs.
+func forgetCachedPIN(serial uint32) error {
+	return nil
+}
+
+func runPINDialog(req PINRequest) (string, error) {
+	text := message("promptDescription", req) + "\n\n" + message("promptLabel", req)
+	if req.WrongPIN {
+		text = "⚠️ " + message("promptWrongPIN", req) + "\n\n" + text
+	}
 	script := new(bytes.Buffer)
-	if err := scriptTemplate.Execute(script, map[string]interface{}{
-		"Serial": serial, "Tries": retries,
+	if err := scriptTemplate.Execute(script, dialog{
+		Title:   message("promptTitle", req),
+		Text:    text,
+		Timeout: req.Timeout,
 	}); err != nil {
 		return "", err
 	}
@@ -40,14 +113,22 @@ func getPIN(serial uint32, retries int) (string, error) {
 	c := exec.Command("osascript", "-s", "se", "-l", "JavaScript")
 	c.Stdin = script
 	out, err := c.Output()
+	if err, ok := err.(*exec.ExitError); ok && bytes.Contains(err.Stderr, []byte("(-128)")) {
+		// The Cancel button raises a "User canceled. (-128)" error.
+		return "", ErrPINCancelled
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to execute osascript: %v", err)
 	}
 	var x struct {
-		PIN string `json:"textReturned"`
+		PIN    string `json:"textReturned"`
+		GaveUp bool   `json:"gaveUp"`
 	}
 	if err := json.Unmarshal(out, &x); err != nil {
 		return "", fmt.Errorf("failed to parse osascript output: %v", err)
 	}
+	if x.GaveUp {
+		return "", ErrPINTimeout
+	}
 	return x.PIN, nil
 }
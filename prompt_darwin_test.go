@@ -0,0 +1,97 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeOsascript puts first in PATH an osascript that reads the script and
+// then runs body.
+func fakeOsascript(t *testing.T, body string) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncat > /dev/null\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "osascript"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunPINDialog(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantPIN string
+		wantErr error
+	}{
+		{
+			name:    "PIN",
+			body:    `echo '{"buttonReturned":"OK","textReturned":"123456"}'`,
+			wantPIN: "123456",
+		},
+		{
+			name:    "cancelled",
+			body:    `echo "execution error: Error: User canceled. (-128)" >&2; exit 1`,
+			wantErr: ErrPINCancelled,
+		},
+		{
+			name:    "timeout",
+			body:    `echo '{"buttonReturned":"","textReturned":"","gaveUp":true}'`,
+			wantErr: ErrPINTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeOsascript(t, tt.body)
+			pin, err := runPINDialog(PINRequest{Serial: 42, Retries: 3})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if pin != tt.wantPIN {
+				t.Errorf("got PIN %q, want %q", pin, tt.wantPIN)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		fakeOsascript(t, `echo "execution error: Error: something else (-1700)" >&2; exit 1`)
+		_, err := runPINDialog(PINRequest{Serial: 42, Retries: 3})
+		if err == nil || errors.Is(err, ErrPINCancelled) {
+			t.Errorf("got error %v, want a failure that is not a cancellation", err)
+		}
+	})
+}
+
+func TestPINDialogNoKeychain(t *testing.T) {
+	// The osascript dialog has no save-to-keychain option that NoCache would
+	// have to remove, so it must be the same either way, and never mention
+	// the keychain.
+	var scripts []string
+	for _, noCache := range []bool{false, true} {
+		var script bytes.Buffer
+		req := PINRequest{Serial: 42, Retries: 3, NoCache: noCache}
+		if err := scriptTemplate.Execute(&script, dialog{
+			Title: message("promptTitle", req),
+			Text:  message("promptDescription", req),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(strings.ToLower(script.String()), "keychain") {
+			t.Errorf("NoCache: %v, but the dialog offers the keychain:\n%s", noCache, script.String())
+		}
+		scripts = append(scripts, script.String())
+	}
+	if scripts[0] != scripts[1] {
+		t.Errorf("the dialog depends on NoCache:\n%s\n%s", scripts[0], scripts[1])
+	}
+}
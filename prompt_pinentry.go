@@ -4,34 +4,283 @@
 // license that can be found in the LICENSE file or at
 // https://developers.google.com/open-source/licenses/bsd
 
-//go:build !darwin
-// +build !darwin
+//go:build !darwin && !windows
+// +build !darwin,!windows
 
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/twpayne/go-pinentry-minimal/pinentry"
 )
 
-func getPIN(serial uint32, retries int) (string, error) {
-	client, err := pinentry.NewClient(
-		pinentry.WithBinaryNameFromGnuPGAgentConf(),
+// pinentryFallbacks are tried in order when the configured pinentry fails to
+// start, for example if it's not installed.
+var pinentryFallbacks = []string{
+	"pinentry-gnome3",
+	"pinentry-qt",
+	"pinentry-gtk-2",
+	"pinentry-curses",
+	"pinentry-tty",
+}
+
+var (
+	pinentryMu sync.Mutex
+	// pinentryBinary is the pinentry that last produced a prompt successfully,
+	// reused for the life of the process.
+	pinentryBinary string
+)
+
+// errPinentryStart is wrapped by the errors of a pinentry that failed to start
+// or to complete the initial handshake, before it could show a prompt. Only
+// then is another pinentry tried, so that the user never gets a second dialog
+// after answering the first one.
+var errPinentryStart = errors.New("pinentry failed to start")
+
+func getPIN(req PINRequest) (string, bool, error) {
+	pinentryMu.Lock()
+	defer pinentryMu.Unlock()
+
+	if pinentryBinary != "" {
+		pin, fromCache, err := runPinentry(pinentryBinary, req)
+		if !errors.Is(err, errPinentryStart) {
+			return pin, fromCache, err
+		}
+		slog.Warn("pinentry failed to start, looking for another one", "pinentry", pinentryBinary, "error", err)
+		pinentryBinary = ""
+	}
+
+	var lastErr error
+	for _, name := range pinentryBinaries() {
+		pin, fromCache, err := runPinentry(name, req)
+		if errors.Is(err, errPinentryStart) {
+			lastErr = fmt.Errorf("%s: %w", name, err)
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		slog.Info("using a new pinentry for PIN prompts", "pinentry", name)
+		pinentryBinary = name
+		return pin, fromCache, nil
+	}
+	return "", false, fmt.Errorf("no working pinentry found: %w", lastErr)
+}
+
+func runPinentry(name string, req PINRequest) (string, bool, error) {
+	opts := []pinentry.ClientOption{
+		pinentry.WithBinaryName(name),
 		pinentry.WithGPGTTY(),
-		pinentry.WithTitle("yubikey-agent PIN Prompt"),
-		pinentry.WithDesc(fmt.Sprintf("YubiKey serial number: %d (%d tries remaining)", serial, retries)),
-		pinentry.WithPrompt("Please enter your PIN:"),
-		// Enable opt-in external PIN caching (in the OS keychain).
-		// https://gist.github.com/mdeguzis/05d1f284f931223624834788da045c65#file-info-pinentry-L324
-		pinentry.WithOption(pinentry.OptionAllowExternalPasswordCache),
-		pinentry.WithKeyInfo(fmt.Sprintf("--yubikey-id-%d", serial)),
-	)
+		pinentry.WithTitle(message("promptTitle", req)),
+		pinentry.WithDesc(message("promptDescription", req)),
+		pinentry.WithPrompt(message("promptLabel", req)),
+	}
+	if !req.NoCache {
+		opts = append(opts,
+			// Enable opt-in external PIN caching (in the OS keychain).
+			// https://gist.github.com/mdeguzis/05d1f284f931223624834788da045c65#file-info-pinentry-L324
+			pinentry.WithOption(pinentry.OptionAllowExternalPasswordCache),
+			pinentry.WithKeyInfo(pinentryKeyInfo(req.Serial)),
+		)
+	}
+	if req.WrongPIN {
+		opts = append(opts, pinentry.WithError(message("promptWrongPIN", req)))
+	}
+	if req.Timeout > 0 {
+		opts = append(opts, pinentry.WithTimeout(req.Timeout))
+	}
+	p := &pinentryProcess{}
+	opts = append(opts, pinentry.WithProcess(p))
+	client, err := pinentry.NewClient(opts...)
 	if err != nil {
-		return "", err
+		return "", false, fmt.Errorf("%w: %v", errPinentryStart, err)
 	}
 	defer client.Close()
 
-	pin, _, err := client.GetPIN()
-	return pin, err
+	if req.Timeout > 0 {
+		// Not every pinentry honors SETTIMEOUT (pinentry-tty and
+		// pinentry-curses don't), so after a short grace period kill it.
+		t := time.AfterFunc(req.Timeout+5*time.Second, p.kill)
+		defer t.Stop()
+	}
+
+	pin, fromCache, err := client.GetPIN()
+	switch {
+	case err == nil:
+		return pin, fromCache, nil
+	case p.killed.Load() || isPinentryTimeout(err):
+		return "", false, ErrPINTimeout
+	case pinentry.IsCancelled(err):
+		return "", false, ErrPINCancelled
+	default:
+		return "", false, err
+	}
+}
+
+// assuanErrorCodeTimeout is GPG_ERR_TIMEOUT from GPG_ERR_SOURCE_PINENTRY.
+const assuanErrorCodeTimeout = 83886142
+
+func isPinentryTimeout(err error) bool {
+	var assuanError *pinentry.AssuanError
+	return errors.As(err, &assuanError) && assuanError.Code == assuanErrorCodeTimeout
+}
+
+// pinentryProcess is a pinentry.Process like the library default, except it
+// can be killed if the user doesn't answer in time.
+type pinentryProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	killed atomic.Bool
+}
+
+func (p *pinentryProcess) Start(name string, args []string) error {
+	p.cmd = exec.Command(name, args...)
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	p.stdin, p.stdout = stdin, bufio.NewReader(stdout)
+	return p.cmd.Start()
+}
+
+func (p *pinentryProcess) ReadLine() ([]byte, bool, error) {
+	return p.stdout.ReadLine()
+}
+
+func (p *pinentryProcess) Write(data []byte) (int, error) {
+	return p.stdin.Write(data)
+}
+
+func (p *pinentryProcess) Close() error {
+	if err := p.stdin.Close(); err != nil {
+		return err
+	}
+	if err := p.cmd.Wait(); err != nil && !p.killed.Load() {
+		return err
+	}
+	return nil
+}
+
+func (p *pinentryProcess) kill() {
+	p.killed.Store(true)
+	p.cmd.Process.Kill()
+}
+
+// confirm asks the user to allow an operation described by desc. Dismissing
+// the dialog or letting it time out counts as denying it.
+func confirm(desc string, timeout time.Duration) (bool, error) {
+	pinentryMu.Lock()
+	name := pinentryBinary
+	pinentryMu.Unlock()
+	if name == "" {
+		name = pinentryBinaries()[0]
+	}
+
+	opts := []pinentry.ClientOption{
+		pinentry.WithBinaryName(name),
+		pinentry.WithGPGTTY(),
+		pinentry.WithTitle(message("confirmTitle", PINRequest{})),
+		pinentry.WithDesc(desc),
+		pinentry.WithOK(message("confirmAllow", PINRequest{})),
+		pinentry.WithCancel(message("confirmDeny", PINRequest{})),
+	}
+	if timeout > 0 {
+		opts = append(opts, pinentry.WithTimeout(timeout))
+	}
+	p := &pinentryProcess{}
+	opts = append(opts, pinentry.WithProcess(p))
+	client, err := pinentry.NewClient(opts...)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	if timeout > 0 {
+		t := time.AfterFunc(timeout+5*time.Second, p.kill)
+		defer t.Stop()
+	}
+
+	ok, err := client.Confirm("")
+	if p.killed.Load() || isPinentryTimeout(err) || pinentry.IsCancelled(err) {
+		return false, nil
+	}
+	return ok, err
+}
+
+func pinentryKeyInfo(serial uint32) string {
+	return fmt.Sprintf("--yubikey-id-%d", serial)
+}
+
+// pinAccepted is a no-op, as pinentry saves the PIN in its external cache by
+// itself.
+func pinAccepted(serial uint32, pin string) {}
+
+// forgetCachedPIN removes the PIN for the YubiKey with the given serial from
+// the pinentry external password cache.
+func forgetCachedPIN(serial uint32) error {
+	pinentryMu.Lock()
+	name := pinentryBinary
+	pinentryMu.Unlock()
+	if name == "" {
+		name = pinentryBinaries()[0]
+	}
+	client, err := pinentry.NewClient(
+		pinentry.WithBinaryName(name),
+		pinentry.WithCommand("CLEARPASSPHRASE "+pinentryKeyInfo(serial)),
+	)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+var gpgAgentConfPinentryRx = regexp.MustCompile(`(?m)^\s*pinentry-program\s+(\S+)`)
+
+// pinentryBinaries returns the pinentry configured in gpg-agent.conf (or just
+// "pinentry" if none is) followed by pinentryFallbacks.
+func pinentryBinaries() []string {
+	configured := "pinentry"
+	if path := gpgAgentConfPath(); path != "" {
+		conf, err := os.ReadFile(path)
+		if m := gpgAgentConfPinentryRx.FindSubmatch(conf); err == nil && m != nil {
+			configured = string(m[1])
+		}
+	}
+	names := []string{configured}
+	for _, name := range pinentryFallbacks {
+		if name != configured {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// gpgAgentConfPath returns the path of gpg-agent.conf, in $GNUPGHOME like gpg
+// does if it's set, or in ~/.gnupg, or "" if neither is known.
+func gpgAgentConfPath() string {
+	if dir := os.Getenv("GNUPGHOME"); dir != "" {
+		return filepath.Join(dir, "gpg-agent.conf")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gnupg", "gpg-agent.conf")
 }
@@ -0,0 +1,190 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePinentryScript speaks just enough of the Assuan protocol to be a
+// pinentry: it accepts every command, logging it to the log file next to
+// it, and answers GETPIN with the contents of the getpin file.
+const fakePinentryScript = `#!/bin/sh
+dir=$(dirname "$0")
+echo "OK Pleased to meet you"
+while read -r cmd; do
+	echo "$cmd" >> "$dir/log"
+	case "$cmd" in
+	GETPIN) cat "$dir/getpin" ;;
+	BYE) echo OK; exit 0 ;;
+	*) echo OK ;;
+	esac
+done
+`
+
+// fakePinentry writes a pinentry that answers GETPIN with getpin, and returns
+// its path and a function that returns the commands it received.
+func fakePinentry(t *testing.T, getpin string) (path string, commands func() []string) {
+	t.Helper()
+	dir := t.TempDir()
+	path = filepath.Join(dir, "pinentry")
+	if err := os.WriteFile(path, []byte(fakePinentryScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "getpin"), []byte(getpin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() []string {
+		log, err := os.ReadFile(filepath.Join(dir, "log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(log)), "\n")
+	}
+}
+
+func TestRunPinentry(t *testing.T) {
+	tests := []struct {
+		name          string
+		getpin        string
+		wantPIN       string
+		wantFromCache bool
+		wantErr       error
+	}{
+		{
+			name:    "PIN",
+			getpin:  "D 123456\nOK\n",
+			wantPIN: "123456",
+		},
+		{
+			name:          "cached PIN",
+			getpin:        "S PASSWORD_FROM_CACHE\nD 123456\nOK\n",
+			wantPIN:       "123456",
+			wantFromCache: true,
+		},
+		{
+			name:    "cancelled",
+			getpin:  "ERR 83886179 Operation cancelled <Pinentry>\n",
+			wantErr: ErrPINCancelled,
+		},
+		{
+			name:    "timeout",
+			getpin:  "ERR 83886142 Timeout <Pinentry>\n",
+			wantErr: ErrPINTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakePinentry(t, tt.getpin)
+			pin, fromCache, err := runPinentry(path, PINRequest{Serial: 42, Retries: 3})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if pin != tt.wantPIN || fromCache != tt.wantFromCache {
+				t.Errorf("got PIN %q (from cache: %v), want %q (%v)", pin, fromCache, tt.wantPIN, tt.wantFromCache)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		path, _ := fakePinentry(t, "ERR 83886081 General error <Pinentry>\n")
+		_, _, err := runPinentry(path, PINRequest{Serial: 42, Retries: 3})
+		if err == nil || errors.Is(err, ErrPINCancelled) || errors.Is(err, errPinentryStart) {
+			t.Errorf("got error %v, want a failure after the start that is not a cancellation", err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := runPinentry(filepath.Join(t.TempDir(), "pinentry"), PINRequest{Serial: 42, Retries: 3})
+		if !errors.Is(err, errPinentryStart) {
+			t.Errorf("got error %v, want errPinentryStart", err)
+		}
+	})
+}
+
+// usePinentries makes pinentryBinaries return configured, from gpg-agent.conf
+// in GNUPGHOME, followed by fallbacks.
+func usePinentries(t *testing.T, configured string, fallbacks ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	conf := "pinentry-program " + configured + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "gpg-agent.conf"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", dir)
+	oldFallbacks := pinentryFallbacks
+	pinentryFallbacks = fallbacks
+	pinentryBinary = ""
+	t.Cleanup(func() {
+		pinentryFallbacks = oldFallbacks
+		pinentryBinary = ""
+	})
+}
+
+func TestPinentryBinariesGNUPGHOME(t *testing.T) {
+	usePinentries(t, "/opt/pinentry-custom", "pinentry-tty")
+	got := pinentryBinaries()
+	if len(got) != 2 || got[0] != "/opt/pinentry-custom" || got[1] != "pinentry-tty" {
+		t.Errorf("got pinentries %q, want the one in $GNUPGHOME/gpg-agent.conf first", got)
+	}
+}
+
+func TestGetPINFallback(t *testing.T) {
+	req := PINRequest{Serial: 42, Retries: 3}
+
+	t.Run("failed start", func(t *testing.T) {
+		working, _ := fakePinentry(t, "D 123456\nOK\n")
+		usePinentries(t, filepath.Join(t.TempDir(), "missing"), working)
+		pin, _, err := getPIN(req)
+		if err != nil || pin != "123456" {
+			t.Fatalf("got %q, %v, want the PIN from the fallback", pin, err)
+		}
+		if pinentryBinary != working {
+			t.Errorf("pinentryBinary is %q, want the fallback", pinentryBinary)
+		}
+	})
+
+	t.Run("failed prompt", func(t *testing.T) {
+		failing, _ := fakePinentry(t, "ERR 83886081 General error <Pinentry>\n")
+		fallback, commands := fakePinentry(t, "D 123456\nOK\n")
+		usePinentries(t, failing, fallback)
+		if _, _, err := getPIN(req); err == nil {
+			t.Fatal("getPIN succeeded after the pinentry failed")
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(fallback), "log")); err == nil {
+			t.Errorf("the fallback was run after a prompt was shown: %q", commands())
+		}
+	})
+}
+
+func TestRunPinentryNoCache(t *testing.T) {
+	for _, noCache := range []bool{false, true} {
+		path, commands := fakePinentry(t, "D 123456\nOK\n")
+		if _, _, err := runPinentry(path, PINRequest{Serial: 42, Retries: 3, NoCache: noCache}); err != nil {
+			t.Fatal(err)
+		}
+		var externalCache, keyInfo bool
+		for _, cmd := range commands() {
+			switch cmd {
+			case "OPTION allow-external-password-cache":
+				externalCache = true
+			case "SETKEYINFO --yubikey-id-42":
+				keyInfo = true
+			}
+		}
+		if externalCache == noCache || keyInfo == noCache {
+			t.Errorf("NoCache: %v, but external password cache: %v, key info: %v", noCache, externalCache, keyInfo)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modcredui = windows.NewLazySystemDLL("credui.dll")
+
+	procCredUIPromptForWindowsCredentialsW = modcredui.NewProc("CredUIPromptForWindowsCredentialsW")
+	procCredPackAuthenticationBufferW      = modcredui.NewProc("CredPackAuthenticationBufferW")
+	procCredUnPackAuthenticationBufferW    = modcredui.NewProc("CredUnPackAuthenticationBufferW")
+)
+
+// credUIInfo is CREDUI_INFOW.
+type credUIInfo struct {
+	size        uint32
+	parent      windows.HWND
+	messageText *uint16
+	captionText *uint16
+	banner      windows.Handle
+}
+
+const (
+	creduiwinGeneric  = 0x1
+	creduiwinCheckbox = 0x2
+)
+
+var (
+	saveMu sync.Mutex
+	// saveRequested records the serials for which the user ticked the "Remember
+	// my credentials" box, to save the PIN once the YubiKey accepts it.
+	saveRequested = make(map[uint32]bool)
+)
+
+// getPIN shows the Windows credential dialog, unless a PIN was saved in the
+// Credential Manager. The dialog can't be dismissed programmatically, so
+// req.Timeout is not enforced.
+func getPIN(req PINRequest) (string, bool, error) {
+	if !req.NoCache {
+		pin, err := keyring.Get(keyringService, keyringAccount(req.Serial))
+		if err == nil {
+			return pin, true, nil
+		}
+		if !errors.Is(err, keyring.ErrNotFound) {
+			slog.Error("failed to read the PIN from the Credential Manager", "serial", req.Serial, "error", err)
+		}
+	}
+	pin, save, err := credUIPrompt(req)
+	if err != nil {
+		return "", false, err
+	}
+	saveMu.Lock()
+	saveRequested[req.Serial] = save
+	saveMu.Unlock()
+	return pin, false, nil
+}
+
+// pinAccepted saves the PIN in the Credential Manager, if the user asked to.
+func pinAccepted(serial uint32, pin string) {
+	saveMu.Lock()
+	save := saveRequested[serial]
+	delete(saveRequested, serial)
+	saveMu.Unlock()
+	if !save {
+		return
+	}
+	if err := keyring.Set(keyringService, keyringAccount(serial), pin); err != nil {
+		slog.Error("failed to save the PIN in the Credential Manager", "serial", serial, "error", err)
+	}
+}
+
+// forgetCachedPIN removes the PIN for the YubiKey with the given serial from
+// the Credential Manager.
+func forgetCachedPIN(serial uint32) error {
+	err := keyring.Delete(keyringService, keyringAccount(serial))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func credUIPrompt(req PINRequest) (pin string, save bool, err error) {
+	text := message("promptDescription", req) + "\n\n" + message("promptLabel", req)
+	if req.WrongPIN {
+		text = message("promptWrongPIN", req) + "\n\n" + text
+	}
+	info := credUIInfo{
+		messageText: windows.StringToUTF16Ptr(text),
+		captionText: windows.StringToUTF16Ptr(message("promptTitle", req)),
+	}
+	info.size = uint32(unsafe.Sizeof(info))
+
+	// Pre-fill the user name, so that only the PIN is left to type.
+	inBuf, _ := packUserName(keyringAccount(req.Serial))
+	var inPtr unsafe.Pointer
+	if len(inBuf) > 0 {
+		inPtr = unsafe.Pointer(&inBuf[0])
+	}
+	var authError uintptr
+	if req.WrongPIN {
+		authError = uintptr(windows.ERROR_LOGON_FAILURE)
+	}
+	flags := uintptr(creduiwinGeneric)
+	if !req.NoCache {
+		flags |= creduiwinCheckbox
+	}
+
+	var authPackage uint32
+	var outBuf unsafe.Pointer
+	var outSize uint32
+	var saveFlag int32
+	r, _, _ := procCredUIPromptForWindowsCredentialsW.Call(
+		uintptr(unsafe.Pointer(&info)), authError, uintptr(unsafe.Pointer(&authPackage)),
+		uintptr(inPtr), uintptr(len(inBuf)), uintptr(unsafe.Pointer(&outBuf)), uintptr(unsafe.Pointer(&outSize)),
+		uintptr(unsafe.Pointer(&saveFlag)), flags)
+	switch errno := syscall.Errno(r); errno {
+	case 0:
+	case windows.ERROR_CANCELLED:
+		return "", false, ErrPINCancelled
+	default:
+		return "", false, fmt.Errorf("credential prompt failed: %w", errno)
+	}
+	defer func() {
+		out := unsafe.Slice((*byte)(outBuf), outSize)
+		for i := range out {
+			out[i] = 0
+		}
+		windows.CoTaskMemFree(outBuf)
+	}()
+
+	var user, domain, password [256]uint16
+	userLen, domainLen, passwordLen := uint32(len(user)), uint32(len(domain)), uint32(len(password))
+	r, _, err = procCredUnPackAuthenticationBufferW.Call(0, uintptr(outBuf), uintptr(outSize),
+		uintptr(unsafe.Pointer(&user[0])), uintptr(unsafe.Pointer(&userLen)),
+		uintptr(unsafe.Pointer(&domain[0])), uintptr(unsafe.Pointer(&domainLen)),
+		uintptr(unsafe.Pointer(&password[0])), uintptr(unsafe.Pointer(&passwordLen)))
+	if r == 0 {
+		return "", false, fmt.Errorf("failed to read the entered PIN: %w", err)
+	}
+	pin = windows.UTF16ToString(password[:])
+	for i := range password {
+		password[i] = 0
+	}
+	return pin, saveFlag != 0, nil
+}
+
+// packUserName returns an authentication buffer with the given user name and
+// an empty password, to pre-fill the credential dialog.
+func packUserName(name string) ([]byte, error) {
+	namePtr := windows.StringToUTF16Ptr(name)
+	emptyPtr := windows.StringToUTF16Ptr("")
+	var size uint32
+	// The first call fails with ERROR_INSUFFICIENT_BUFFER and sets size.
+	procCredPackAuthenticationBufferW.Call(0, uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(emptyPtr)), 0, uintptr(unsafe.Pointer(&size)))
+	if size == 0 {
+		return nil, errors.New("failed to size the authentication buffer")
+	}
+	buf := make([]byte, size)
+	r, _, err := procCredPackAuthenticationBufferW.Call(0, uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(emptyPtr)), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// confirm asks the user to allow an operation described by desc. The message
+// box can't time out, so timeout is not enforced.
+func confirm(desc string, timeout time.Duration) (bool, error) {
+	ret, err := windows.MessageBox(0, windows.StringToUTF16Ptr(desc),
+		windows.StringToUTF16Ptr(message("confirmTitle", PINRequest{})),
+		windows.MB_YESNO|windows.MB_ICONWARNING|windows.MB_DEFBUTTON2|windows.MB_SYSTEMMODAL)
+	if ret == 0 {
+		return false, err
+	}
+	const idYes = 6
+	return ret == idYes, nil
+}
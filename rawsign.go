@@ -0,0 +1,124 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// rawSignExtension signs arbitrary data with the key in slot 9a (or the slot
+// chosen with selectSlotExtension), for uses other than SSH, like signing
+// release artifacts. The contents are the data as an SSH string. The reply is
+// SSH_AGENT_SUCCESS followed by two SSH strings: the algorithm, named like in
+// JWS (ES256, ES384, or RS256), and the signature, ASN.1 DER for ECDSA and
+// PKCS #1 v1.5 for RSA, over the SHA-256 (or SHA-384 for P-384) hash of the
+// data.
+//
+// A raw signature could be used in any protocol, like X.509 or JWS, so it's
+// not available on restricted or forwarded connections, and the user always
+// has to confirm it.
+const rawSignExtension = "raw-sign@filippo.io"
+
+// errForwardedRawSign is returned for rawSignExtension requests on forwarded
+// connections.
+var errForwardedRawSign = errors.New("raw signatures are not available on forwarded agent connections")
+
+func (c *client) rawSign(contents []byte) ([]byte, error) {
+	if c.policy.Restricted {
+		return nil, errRestricted
+	}
+	if c.forwarded {
+		return nil, errForwardedRawSign
+	}
+	var req struct {
+		Data []byte
+	}
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse %s request: %w", rawSignExtension, err)
+	}
+	slot := piv.SlotAuthentication
+	if c.slot != nil {
+		slot = *c.slot
+	}
+	alg, sig, err := c.Agent.rawSign(c, slot, req.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{agentSuccess}, ssh.Marshal(struct {
+		Algorithm string
+		Signature []byte
+	}{alg, sig})...), nil
+}
+
+// rawSign signs the hash of data with the key in slot, returning the JWS name
+// of the algorithm and the signature.
+func (a *Agent) rawSign(c *client, slot piv.Slot, data []byte) (string, []byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return "", nil, errAgentLocked
+	}
+	if err := a.ensureYK(); err != nil {
+		return "", nil, fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	defer a.maybeReleaseYK()
+
+	a.caller = c
+	defer func() { a.caller = nil }()
+
+	keys, err := a.publicKeys()
+	if err != nil {
+		return "", nil, err
+	}
+	keys = keysInSlot(keys, slot)
+	if len(keys) == 0 {
+		return "", nil, fmt.Errorf("no key in slot %s", slot)
+	}
+	k := keys[0]
+	pub := k.pk.(ssh.CryptoPublicKey).CryptoPublicKey()
+	priv, err := a.yk.PrivateKey(slot, pub,
+		piv.KeyAuth{PINPrompt: func() (string, error) { return a.getPIN(k) }})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to prepare private key: %w", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return "", nil, fmt.Errorf("key in slot %s can't sign", slot)
+	}
+
+	var alg string
+	var hash crypto.Hash
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		alg, hash = "ES256", crypto.SHA256
+		if pub.Curve == elliptic.P384() {
+			alg, hash = "ES384", crypto.SHA384
+		}
+	case *rsa.PublicKey:
+		alg, hash = "RS256", crypto.SHA256
+	default:
+		return "", nil, fmt.Errorf("%w: %T", errUnsupportedKey, pub)
+	}
+	h := hash.New()
+	h.Write(data)
+
+	var sig []byte
+	err = a.signGated(c, slot, k.pk, true, func() (err error) {
+		sig, err = signer.Sign(rand.Reader, h.Sum(nil), hash)
+		return err
+	})
+	return alg, sig, err
+}
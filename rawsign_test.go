@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRawSign(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	tests := []struct {
+		name          string
+		policy        connPolicy
+		forwarded     bool
+		alwaysConfirm bool
+		allow         bool
+		wantAsked     int
+		wantErr       error
+	}{
+		{name: "allowed", allow: true, wantAsked: 1},
+		{name: "allowed with -always-confirm", alwaysConfirm: true, allow: true, wantAsked: 1},
+		{name: "denied", wantAsked: 1, wantErr: ErrNotConfirmed},
+		{name: "forwarded", forwarded: true, allow: true, wantErr: errForwardedRawSign},
+		{name: "restricted", policy: connPolicy{Restricted: true}, allow: true, wantErr: errRestricted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}})
+			a.AlwaysConfirm = tt.alwaysConfirm
+			var asked int
+			a.ConfirmPrompt = func(desc string, timeout time.Duration) (bool, error) {
+				asked++
+				return tt.allow, nil
+			}
+			c := &client{Agent: a, id: 1, policy: tt.policy, forwarded: tt.forwarded}
+			signs := d.signs
+
+			data := []byte("release artifact")
+			reply, err := c.rawSign(ssh.Marshal(struct{ Data []byte }{data}))
+			if asked != tt.wantAsked {
+				t.Errorf("the user was asked %d times, want %d", asked, tt.wantAsked)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if d.signs != signs {
+					t.Errorf("the YubiKey signed anyway")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply[0] != agentSuccess {
+				t.Fatalf("got reply type %d, want success", reply[0])
+			}
+			var res struct {
+				Algorithm string
+				Signature []byte
+			}
+			if err := ssh.Unmarshal(reply[1:], &res); err != nil {
+				t.Fatal(err)
+			}
+			pub := d.publicKey(t, piv.SlotAuthentication).(ssh.CryptoPublicKey).CryptoPublicKey().(*ecdsa.PublicKey)
+			h := sha256.Sum256(data)
+			if res.Algorithm != "ES256" || !ecdsa.VerifyASN1(pub, h[:], res.Signature) {
+				t.Errorf("got an invalid %s signature", res.Algorithm)
+			}
+		})
+	}
+}
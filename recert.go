@@ -0,0 +1,67 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// runRecert replaces the certificate in slot with a new self-signed one over
+// the same public key, for example if the old one expired. The key itself,
+// and so the SSH public key, doesn't change.
+func runRecert(yk *piv.YubiKey, slot piv.Slot) {
+	defer yk.Close()
+
+	pub, err := slotPublicKey(yk, slot)
+	if err != nil {
+		log.Fatalf("Failed to read the public key in slot %s: %v", slot, err)
+	}
+
+	// Keep the name of the old certificate, which might carry a warning.
+	commonName := "SSH key"
+	if old, err := yk.Certificate(slot); err == nil && old.Subject.CommonName != "" {
+		commonName = old.Subject.CommonName
+	}
+
+	mk := managementKeyFromMetadata(yk)
+
+	cert, err := selfSignedCertificate(pub, commonName)
+	if err != nil {
+		log.Fatalln("Failed to generate certificate:", err)
+	}
+	if err := yk.SetCertificate(mk, slot, cert); err != nil {
+		log.Fatalln("Failed to store certificate:", err)
+	}
+
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		log.Fatalln("Failed to generate public key:", err)
+	}
+	fmt.Println("✅ Done! The certificate in slot", slot, "was replaced.")
+	fmt.Println("🔑 The SSH public key is unchanged:")
+	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
+}
+
+// slotPublicKey returns the public key of the key in slot. Keys generated on
+// the device are read from their attestation, and imported keys, which can't
+// be attested, from the current certificate.
+func slotPublicKey(yk *piv.YubiKey, slot piv.Slot) (crypto.PublicKey, error) {
+	cert, err := yk.Attest(slot)
+	if err == nil {
+		return cert.PublicKey, nil
+	}
+	if cert, certErr := yk.Certificate(slot); certErr == nil {
+		return cert.PublicKey, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state, like "READY=1", to the service manager if it asked for
+// notifications by setting NOTIFY_SOCKET, like systemd does for Type=notify
+// services. See sd_notify(3).
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Error("failed to notify the service manager", "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Error("failed to notify the service manager", "error", err)
+	}
+}
+
+// watchdogMaxFailures is how many health checks in a row can fail before the
+// watchdog pings stop.
+const watchdogMaxFailures = 3
+
+// sdWatchdog pings the service manager watchdog in the background, if it's
+// enabled with WatchdogSec, at half the requested interval. Before each ping
+// it runs check, and if that fails watchdogMaxFailures times in a row, it
+// stops pinging, so that the service manager restarts the agent.
+func sdWatchdog(check func() error) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		var failures int
+		for range time.Tick(interval) {
+			if err := check(); err != nil {
+				failures++
+				slog.Error("health check failed", "failures", failures, "max_failures", watchdogMaxFailures, "error", err)
+				if failures >= watchdogMaxFailures {
+					slog.Error("stopping the watchdog pings, the service manager should restart the agent")
+					sdNotify("STATUS=Health check failing: " + err.Error())
+					return
+				}
+			} else {
+				failures = 0
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
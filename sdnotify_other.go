@@ -0,0 +1,15 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !linux
+// +build !linux
+
+package main
+
+// sdNotify is a no-op outside of Linux, where there is no systemd.
+func sdNotify(state string) {}
+
+func sdWatchdog(check func() error) {}
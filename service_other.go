@@ -0,0 +1,24 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "log"
+
+func installService(args []string) {
+	log.Fatalln("-install-windows-service is only supported on Windows.")
+}
+
+func removeService() {
+	log.Fatalln("-remove-windows-service is only supported on Windows.")
+}
+
+func inService() bool { return false }
+
+func runService(run func()) { run() }
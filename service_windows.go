@@ -0,0 +1,181 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"golang.org/x/term"
+)
+
+const serviceName = "yubikey-agent"
+
+// installService installs the agent as a service that runs as the current
+// user, so that it can use the PIN saved in their Credential Manager and only
+// they can connect to its named pipe. args are passed to the agent.
+func installService(args []string) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Failed to find the agent executable:", err)
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		log.Fatalln("Failed to get the current user:", err)
+	}
+	account, domain, _, err := user.User.Sid.LookupAccount("")
+	if err != nil {
+		log.Fatalln("Failed to get the current user:", err)
+	}
+	fmt.Printf("Windows password for %s\\%s: ", domain, account)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Print("\n")
+	if err != nil {
+		log.Fatalln("Failed to read password:", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalln("Failed to connect to the service manager, run as administrator:", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName:      "yubikey-agent",
+		Description:      "SSH agent for YubiKeys",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: domain + `\` + account,
+		Password:         string(password),
+	}, args...)
+	if err != nil {
+		log.Fatalln("Failed to install the service:", err)
+	}
+	defer s.Close()
+	// Like Restart=on-failure in the systemd unit, restart the agent if it
+	// crashes or exits on its own, but give up if it keeps failing.
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.NoAction},
+	}, uint32((24 * time.Hour).Seconds())); err != nil {
+		log.Println("Failed to set the service to restart on failure:", err)
+	} else if err := setRecoveryOnNonCrashFailures(s); err != nil {
+		log.Println("Failed to set the service to restart on failure:", err)
+	}
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		log.Fatalln("Failed to register the event log source:", err)
+	}
+	if err := s.Start(); err != nil {
+		log.Fatalln("Installed the service, but failed to start it:", err)
+	}
+	fmt.Println("✅ Installed and started the yubikey-agent service.")
+}
+
+// setRecoveryOnNonCrashFailures makes the recovery actions of s apply also
+// when it stops with an error, not only when it crashes.
+func setRecoveryOnNonCrashFailures(s *mgr.Service) error {
+	// SERVICE_FAILURE_ACTIONS_FLAG.
+	flag := struct{ failureActionsOnNonCrashFailures int32 }{1}
+	return windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS_FLAG,
+		(*byte)(unsafe.Pointer(&flag)))
+}
+
+// removeService stops and removes the service installed by installService.
+func removeService() {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalln("Failed to connect to the service manager, run as administrator:", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		log.Fatalln("Failed to open the service:", err)
+	}
+	defer s.Close()
+	s.Control(svc.Stop)
+	if err := s.Delete(); err != nil {
+		log.Fatalln("Failed to remove the service:", err)
+	}
+	eventlog.Remove(serviceName)
+	fmt.Println("✅ Removed the yubikey-agent service.")
+}
+
+// inService reports whether the agent was started by the service manager.
+func inService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs the agent with run, logging to the event log, until the
+// service manager stops it.
+func runService(run func()) {
+	if l, err := eventlog.Open(serviceName); err == nil {
+		slog.SetDefault(slog.New(newEventLogHandler(l)))
+	}
+	if err := svc.Run(serviceName, agentService{run}); err != nil {
+		logFatal("failed to run as a service", "error", err)
+	}
+}
+
+type agentService struct {
+	run func()
+}
+
+func (s agentService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				// runAgent closes the listeners and the YubiKey, and returns.
+				shutdown <- syscall.SIGTERM
+				<-done
+				return false, 0
+			}
+		case <-done:
+			// The agent stopped without being asked to, so report a failure
+			// for the recovery actions to restart it.
+			return true, 1
+		}
+	}
+}
+
+// newEventLogHandler returns a handler that sends each record to the Windows
+// event log, with the event type of its level and the attributes appended to
+// the message by formatLogLine.
+func newEventLogHandler(l *eventlog.Log) slog.Handler {
+	return &recordHandler{emit: func(r slog.Record, attrs []slog.Attr) error {
+		line := formatLogLine(r.Message, attrs)
+		switch {
+		case r.Level >= slog.LevelError:
+			return l.Error(1, line)
+		case r.Level >= slog.LevelWarn:
+			return l.Warning(1, line)
+		default:
+			return l.Info(1, line)
+		}
+	}}
+}
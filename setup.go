@@ -7,7 +7,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -19,9 +21,10 @@ import (
 	"math/big"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/go-piv/piv-go/piv"
+	"github.com/go-piv/piv-go/v2/piv"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
@@ -42,14 +45,44 @@ func init() {
 	Version = "(unknown version)"
 }
 
-func connectForSetup() *piv.YubiKey {
-	yk, err := openYK()
-	if err != nil {
+// Exit codes of the commands other than the agent, for scripts. Any other
+// failure exits with status 1.
+const (
+	exitNoYubiKey    = 2 // no YubiKey is connected
+	exitCardInUse    = 3 // another application holds the YubiKey
+	exitAuthFailed   = 4 // the PIN, PUK, or Management Key was rejected
+	exitAlreadySetUp = 5 // -setup found an existing key
+)
+
+// fatal is like log.Fatalln, but exits with the given code.
+func fatal(code int, v ...interface{}) {
+	log.Println(v...)
+	os.Exit(code)
+}
+
+func connectForSetup(wait time.Duration) *piv.YubiKey {
+	yk, err := openYKWait(wait)
+	switch {
+	case errors.Is(err, errNoYubiKey):
+		fatal(exitNoYubiKey, "Failed to connect to the YubiKey:", err)
+	case isSharingViolation(err):
+		fatal(exitCardInUse, "Failed to connect to the YubiKey:", err)
+	case err != nil:
 		log.Fatalln("Failed to connect to the YubiKey:", err)
 	}
 	return yk
 }
 
+// scardSharingViolationMessage is how piv-go describes the
+// SCARD_E_SHARING_VIOLATION (0x8010000B) PC/SC error, returned when another
+// application has the YubiKey open. piv-go wraps it in an unexported type with
+// no accessor for the code, so matching the message is the only way to tell.
+const scardSharingViolationMessage = "the smart card cannot be accessed because of other connections outstanding"
+
+func isSharingViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), scardSharingViolationMessage)
+}
+
 func runReset(yk *piv.YubiKey) {
 	fmt.Print(`Do you want to reset the PIV applet? This will delete all PIV keys. Type "delete": `)
 	var res string
@@ -66,42 +99,176 @@ func runReset(yk *piv.YubiKey) {
 	}
 }
 
-func runSetup(yk *piv.YubiKey) {
-	if _, err := yk.Certificate(piv.SlotAuthentication); err == nil {
-		log.Println("‼️  This YubiKey looks already setup")
-		log.Println("")
-		log.Println("If you want to wipe all PIV keys and start fresh,")
-		log.Fatalln("use --really-delete-all-piv-keys ⚠️")
-	} else if !errors.Is(err, piv.ErrNotFound) {
-		log.Fatalln("Failed to access authentication slot:", err)
+// newPINAttempts is how many times readNewPIN lets the user try again after a
+// typo, before giving up.
+const newPINAttempts = 3
+
+// readNewPIN asks for the new PIN twice, without echoing it, and lets the user
+// start over if it's too short or long or the two don't match.
+func readNewPIN() []byte {
+	for attempt := 1; ; attempt++ {
+		fmt.Print("Choose a new PIN/PUK: ")
+		pin, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Print("\n")
+		if err != nil {
+			log.Fatalln("Failed to read PIN:", err)
+		}
+		// The limits are in bytes, which is what len counts here, not characters.
+		if len(pin) < 6 || len(pin) > 8 {
+			log.Println("The PIN needs to be 6-8 bytes long.")
+			log.Println("Letters with accents and other non-ASCII characters take more than one byte each.")
+		} else {
+			fmt.Print("Repeat PIN/PUK: ")
+			repeat, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Print("\n")
+			if err != nil {
+				log.Fatalln("Failed to read PIN:", err)
+			}
+			if bytes.Equal(repeat, pin) {
+				return pin
+			}
+			log.Println("PINs don't match!")
+		}
+		if attempt == newPINAttempts {
+			log.Fatalln("Giving up, nothing was changed on the YubiKey.")
+		}
+		fmt.Println("")
 	}
+}
+
+func runSetup(yk *piv.YubiKey) {
+	checkNotSetUp(yk)
 
 	fmt.Println("🔐 The PIN is up to 8 numbers, letters, or symbols. Not just numbers!")
 	fmt.Println("❌ The key will be lost if the PIN and PUK are locked after 3 incorrect tries.")
 	fmt.Println("")
-	fmt.Print("Choose a new PIN/PUK: ")
-	pin, err := term.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Print("\n")
+	pin := readNewPIN()
+
+	sshKey := provision(yk, pin)
+
+	fmt.Println("")
+	fmt.Println("✅ Done! This YubiKey is secured and ready to go.")
+	fmt.Println("🤏 When the YubiKey blinks, touch it to authorize the login.")
+	fmt.Println("")
+	fmt.Println("🔑 Here's your new shiny SSH public key:")
+	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
+	fmt.Println("")
+	fmt.Println("🔍 Its fingerprint, to check it's the one registered on servers:")
+	fmt.Println(ssh.FingerprintSHA256(sshKey))
+	fmt.Println("")
+	fmt.Println("Next steps: ensure yubikey-agent is running via launchd/systemd/...,")
+	fmt.Println(`set the SSH_AUTH_SOCK environment variable, and test with "ssh-add -L"`)
+	fmt.Println("")
+	fmt.Println("💭 Remember: everything breaks, have a backup plan for when this YubiKey does.")
+	fmt.Println(`   "yubikey-agent -setup -backup" sets up a second YubiKey alongside this one.`)
+}
+
+// runSetupBackup sets up two YubiKeys the same way, with the same PIN, asking
+// to swap them in between. Keys can't be copied between YubiKeys, so each has
+// its own key, and both public keys need to be registered on servers.
+func runSetupBackup(wait time.Duration, reset bool) {
+	fmt.Println("🥇 First, the primary YubiKey.")
+	fmt.Println("")
+	yk := connectForSetup(wait)
+	if reset {
+		runReset(yk)
+	}
+	checkNotSetUp(yk)
+	primarySerial, err := yk.Serial()
 	if err != nil {
-		log.Fatalln("Failed to read PIN:", err)
+		log.Fatalln("Failed to read the serial number:", err)
 	}
-	if len(pin) < 6 || len(pin) > 8 {
-		log.Fatalln("The PIN needs to be 6-8 characters.")
+
+	fmt.Println("🔐 The PIN is up to 8 numbers, letters, or symbols. Not just numbers!")
+	fmt.Println("❌ The keys will be lost if the PIN and PUK are locked after 3 incorrect tries.")
+	fmt.Println("👯 The same PIN and PUK will be set on both YubiKeys.")
+	fmt.Println("")
+	pin := readNewPIN()
+	defer func() {
+		for i := range pin {
+			pin[i] = 0
+		}
+	}()
+
+	primary := provision(yk, pin)
+	yk.Close()
+
+	fmt.Println("")
+	fmt.Println("✅ The primary YubiKey is ready. Here is its SSH public key, in case")
+	fmt.Println("   something goes wrong with the backup one:")
+	printLabeledKey(primary, fmt.Sprintf("primary YubiKey #%d", primarySerial))
+	fmt.Println("")
+	stdin := bufio.NewReader(os.Stdin)
+	var backupSerial uint32
+	for {
+		fmt.Print("🔁 Unplug it, plug in the backup YubiKey, and press Enter. ")
+		if _, err := stdin.ReadString('\n'); err != nil {
+			log.Fatalln("Failed to read response:", err)
+		}
+		yk = connectForSetup(wait)
+		backupSerial, err = yk.Serial()
+		if err != nil {
+			log.Fatalln("Failed to read the serial number:", err)
+		}
+		if backupSerial != primarySerial {
+			break
+		}
+		yk.Close()
+		fmt.Println("That's still the primary YubiKey.")
 	}
-	fmt.Print("Repeat PIN/PUK: ")
-	repeat, err := term.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Print("\n")
-	if err != nil {
-		log.Fatalln("Failed to read PIN:", err)
-	} else if !bytes.Equal(repeat, pin) {
-		log.Fatalln("PINs don't match!")
+	if reset {
+		runReset(yk)
 	}
+	checkNotSetUp(yk)
+	backup := provision(yk, pin)
+	yk.Close()
 
+	fmt.Println("")
+	fmt.Println("✅ Done! Both YubiKeys are secured and ready to go.")
+	fmt.Println("🤏 When the YubiKey blinks, touch it to authorize the login.")
+	fmt.Println("")
+	fmt.Println("🔑 Here are the SSH public keys. Add both to authorized_keys, and")
+	fmt.Println("   keep the backup YubiKey somewhere safe:")
+	printLabeledKey(primary, fmt.Sprintf("primary YubiKey #%d", primarySerial))
+	printLabeledKey(backup, fmt.Sprintf("backup YubiKey #%d", backupSerial))
+	fmt.Println("")
+	fmt.Println("🔍 Their fingerprints, to check they're the ones registered on servers:")
+	fmt.Println("Primary:", ssh.FingerprintSHA256(primary))
+	fmt.Println("Backup: ", ssh.FingerprintSHA256(backup))
+	fmt.Println("")
+	fmt.Println("Next steps: ensure yubikey-agent is running via launchd/systemd/...,")
+	fmt.Println(`set the SSH_AUTH_SOCK environment variable, and test with "ssh-add -L"`)
+}
+
+// printLabeledKey prints k in authorized_keys format, with label as comment.
+func printLabeledKey(k ssh.PublicKey, label string) {
+	line := bytes.TrimSpace(ssh.MarshalAuthorizedKey(k))
+	fmt.Printf("%s %s\n", line, label)
+}
+
+// checkNotSetUp exits if the YubiKey already has a key in slot 9a.
+func checkNotSetUp(yk *piv.YubiKey) {
+	if _, err := yk.Certificate(piv.SlotAuthentication); err == nil {
+		log.Println("‼️  This YubiKey looks already setup")
+		log.Println("")
+		log.Println("If you want to wipe all PIV keys and start fresh,")
+		fatal(exitAlreadySetUp, "use --really-delete-all-piv-keys ⚠️")
+	} else if !errors.Is(err, piv.ErrNotFound) {
+		log.Fatalln("Failed to access authentication slot:", err)
+	}
+}
+
+// provision sets a random Management Key, the PIN and PUK, and generates a key
+// in slot 9a, returning its public key.
+func provision(yk *piv.YubiKey, pin []byte) ssh.PublicKey {
 	fmt.Println("")
 	fmt.Println("🧪 Reticulating splines...")
 
-	var key [24]byte
-	if _, err := rand.Read(key[:]); err != nil {
+	// A 24-byte Management Key is set as AES-192 on firmware 5.4 and later,
+	// which deprecates TDES, and as TDES on older YubiKeys. piv-go detects
+	// which one it is when authenticating with it later.
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
 		log.Fatal(err)
 	}
 	if err := yk.SetManagementKey(piv.DefaultManagementKey, key); err != nil {
@@ -111,7 +278,7 @@ func runSetup(yk *piv.YubiKey) {
 		log.Println("Management Key to the defaults before retrying.")
 		log.Println("")
 		log.Println("If you want to wipe all PIV keys and start fresh,")
-		log.Fatalln("use --really-delete-all-piv-keys ⚠️")
+		fatal(exitAuthFailed, "use --really-delete-all-piv-keys ⚠️")
 	}
 	if err := yk.SetMetadata(key, &piv.Metadata{
 		ManagementKey: &key,
@@ -125,7 +292,7 @@ func runSetup(yk *piv.YubiKey) {
 		log.Println("Management Key to the defaults before retrying.")
 		log.Println("")
 		log.Println("If you want to wipe all PIV keys and start fresh,")
-		log.Fatalln("use --really-delete-all-piv-keys ⚠️")
+		fatal(exitAuthFailed, "use --really-delete-all-piv-keys ⚠️")
 	}
 	if err := yk.SetPUK(piv.DefaultPUK, string(pin)); err != nil {
 		log.Println("‼️  The default PUK did not work")
@@ -134,7 +301,7 @@ func runSetup(yk *piv.YubiKey) {
 		log.Println("Management Key to the defaults before retrying.")
 		log.Println("")
 		log.Println("If you want to wipe all PIV keys and start fresh,")
-		log.Fatalln("use --really-delete-all-piv-keys ⚠️")
+		fatal(exitAuthFailed, "use --really-delete-all-piv-keys ⚠️")
 	}
 
 	pub, err := yk.GenerateKey(key, piv.SlotAuthentication, piv.Key{
@@ -146,9 +313,53 @@ func runSetup(yk *piv.YubiKey) {
 		log.Fatalln("Failed to generate key:", err)
 	}
 
+	cert, err := selfSignedCertificate(pub, "SSH key")
+	if err != nil {
+		log.Fatalln("Failed to generate certificate:", err)
+	}
+	if err := yk.SetCertificate(key, piv.SlotAuthentication, cert); err != nil {
+		log.Fatalln("Failed to store certificate:", err)
+	}
+
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		log.Fatalln("Failed to generate public key:", err)
+	}
+	return sshKey
+}
+
+// managementKeyFromMetadata asks for the PIN, and returns the Management Key
+// that -setup stored in the PIN-protected metadata.
+func managementKeyFromMetadata(yk *piv.YubiKey) []byte {
+	fmt.Print("Enter PIN: ")
+	pin, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Print("\n")
+	if err != nil {
+		log.Fatalln("Failed to read PIN:", err)
+	}
+	md, err := yk.Metadata(string(pin))
+	if err != nil {
+		var authErr piv.AuthErr
+		if errors.As(err, &authErr) {
+			fatal(exitAuthFailed, "Failed to read the Management Key from the device:", err)
+		}
+		log.Fatalln("Failed to read the Management Key from the device:", err)
+	}
+	if md.ManagementKey == nil {
+		log.Println("‼️  No Management Key is stored on this YubiKey")
+		log.Println("")
+		log.Fatalln("Only YubiKeys configured with -setup are supported.")
+	}
+	return *md.ManagementKey
+}
+
+// selfSignedCertificate returns a certificate for pub, signed by a throwaway
+// parent key. It only serves to mark the slot as used by yubikey-agent, and
+// commonName to describe the key to other tools.
+func selfSignedCertificate(pub crypto.PublicKey, commonName string) (*x509.Certificate, error) {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		log.Fatalln("Failed to generate parent key:", err)
+		return nil, fmt.Errorf("failed to generate parent key: %w", err)
 	}
 	parent := &x509.Certificate{
 		Subject: pkix.Name{
@@ -159,7 +370,7 @@ func runSetup(yk *piv.YubiKey) {
 	}
 	template := &x509.Certificate{
 		Subject: pkix.Name{
-			CommonName: "SSH key",
+			CommonName: commonName,
 		},
 		NotAfter:     time.Now().AddDate(42, 0, 0),
 		NotBefore:    time.Now(),
@@ -168,32 +379,9 @@ func runSetup(yk *piv.YubiKey) {
 	}
 	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
 	if err != nil {
-		log.Fatalln("Failed to generate certificate:", err)
+		return nil, err
 	}
-	cert, err := x509.ParseCertificate(certBytes)
-	if err != nil {
-		log.Fatalln("Failed to parse certificate:", err)
-	}
-	if err := yk.SetCertificate(key, piv.SlotAuthentication, cert); err != nil {
-		log.Fatalln("Failed to store certificate:", err)
-	}
-
-	sshKey, err := ssh.NewPublicKey(pub)
-	if err != nil {
-		log.Fatalln("Failed to generate public key:", err)
-	}
-
-	fmt.Println("")
-	fmt.Println("✅ Done! This YubiKey is secured and ready to go.")
-	fmt.Println("🤏 When the YubiKey blinks, touch it to authorize the login.")
-	fmt.Println("")
-	fmt.Println("🔑 Here's your new shiny SSH public key:")
-	os.Stdout.Write(ssh.MarshalAuthorizedKey(sshKey))
-	fmt.Println("")
-	fmt.Println("Next steps: ensure yubikey-agent is running via launchd/systemd/...,")
-	fmt.Println(`set the SSH_AUTH_SOCK environment variable, and test with "ssh-add -L"`)
-	fmt.Println("")
-	fmt.Println("💭 Remember: everything breaks, have a backup plan for when this YubiKey does.")
+	return x509.ParseCertificate(certBytes)
 }
 
 func randomSerialNumber() *big.Int {
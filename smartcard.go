@@ -0,0 +1,230 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+// Message numbers of the smartcard requests of the agent protocol, sent by
+// "ssh-add -s" and "ssh-add -e", which golang.org/x/crypto/ssh/agent doesn't
+// handle.
+const (
+	agentAddSmartcardKey            = 20
+	agentRemoveSmartcardKey         = 21
+	agentAddSmartcardKeyConstrained = 26
+
+	agentFailure = 5
+	agentSuccess = 6
+
+	agentConstrainLifetime = 1
+	agentConstrainConfirm  = 2
+)
+
+// maxRequestSize is the largest request read from a client, like the limit of
+// golang.org/x/crypto/ssh/agent.
+const maxRequestSize = 256 * 1024
+
+// smartcardConn answers the smartcard requests of the agent protocol itself,
+// and passes every other request on to agent.ServeAgent.
+//
+// The keys can't be added or removed, as they live on the YubiKey, so instead
+// "ssh-add -s" verifies and caches the PIN it sends, and "ssh-add -e" forgets
+// it. This maps "ssh-add -s yubikey -t 1h" to unlocking the YubiKey for an hour.
+type smartcardConn struct {
+	net.Conn
+	client *client
+
+	// pending is the rest of the request being read by agent.ServeAgent.
+	pending []byte
+}
+
+func (c *smartcardConn) Read(b []byte) (int, error) {
+	// agent.ServeAgent reads a request, and writes the reply before reading
+	// the next, so replying here in between keeps the replies in order.
+	for len(c.pending) == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+			return 0, err
+		}
+		l := binary.BigEndian.Uint32(length[:])
+		if l > maxRequestSize {
+			return 0, fmt.Errorf("agent: request too large: %d", l)
+		}
+		req := make([]byte, l)
+		if _, err := io.ReadFull(c.Conn, req); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		reply, ok := c.client.smartcardRequest(req)
+		if !ok {
+			c.pending = append(length[:], req...)
+			break
+		}
+		binary.BigEndian.PutUint32(length[:], uint32(len(reply)))
+		if _, err := c.Conn.Write(append(length[:], reply...)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// smartcardRequest handles req if it's a smartcard request or empty, and
+// returns the reply to send.
+func (c *client) smartcardRequest(req []byte) (reply []byte, ok bool) {
+	if len(req) == 0 {
+		// agent.ServeAgent would drop the connection, but answering is
+		// enough for the client to notice its mistake.
+		slog.Warn("empty request", "connection", c.id)
+		return []byte{agentFailure}, true
+	}
+	var err error
+	switch req[0] {
+	case agentAddSmartcardKey, agentAddSmartcardKeyConstrained, agentRemoveSmartcardKey:
+		if c.policy.Restricted {
+			err = errRestricted
+		} else if req[0] == agentRemoveSmartcardKey {
+			c.forgetPIN()
+			c.logInfo("PIN forgotten at the request of a connection", "event", "pin-forgotten", "connection", c.id)
+		} else {
+			err = c.addSmartcardKey(req[1:])
+		}
+	default:
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("smartcard request failed", "connection", c.id, "error", err)
+		return []byte{agentFailure}, true
+	}
+	return []byte{agentSuccess}, true
+}
+
+func (c *client) addSmartcardKey(contents []byte) error {
+	var msg struct {
+		ReaderID    string
+		PIN         []byte
+		Constraints []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return fmt.Errorf("failed to parse request: %w", err)
+	}
+	lifetime, err := parseLifetimeConstraint(msg.Constraints)
+	if err != nil {
+		return err
+	}
+	pin := string(msg.PIN)
+	for i := range msg.PIN {
+		msg.PIN[i] = 0
+	}
+	return c.Agent.unlockPIN(pin, lifetime)
+}
+
+// parseLifetimeConstraint returns the lifetime in constraints, or zero if
+// there is none. The confirm constraint is accepted, as -always-confirm
+// already covers it, but extensions are refused, as their meaning can't be
+// honored.
+func parseLifetimeConstraint(constraints []byte) (time.Duration, error) {
+	var lifetime time.Duration
+	for len(constraints) > 0 {
+		switch constraints[0] {
+		case agentConstrainLifetime:
+			if len(constraints) < 5 {
+				return 0, errors.New("malformed lifetime constraint")
+			}
+			lifetime = time.Duration(binary.BigEndian.Uint32(constraints[1:5])) * time.Second
+			constraints = constraints[5:]
+		case agentConstrainConfirm:
+			constraints = constraints[1:]
+		default:
+			return 0, fmt.Errorf("unsupported constraint type %d", constraints[0])
+		}
+	}
+	return lifetime, nil
+}
+
+// unlockPIN verifies pin and stores it in memory, in unlockedPINs, so that
+// later operations don't prompt for it. It's never stored in PINCache, which
+// might be persistent. If lifetime is not zero, the PIN is forgotten after
+// that long.
+func (a *Agent) unlockPIN(pin string, lifetime time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockHash != nil {
+		return errAgentLocked
+	}
+	if a.NoPINCache {
+		return errors.New("the PIN cache is disabled by -no-pin-cache")
+	}
+	if a.unlockedPINs == nil {
+		return errors.New("the agent can't remember PINs")
+	}
+	if err := a.ensureYK(); err != nil {
+		return fmt.Errorf("could not reach YubiKey: %w", err)
+	}
+	defer a.maybeReleaseYK()
+
+	if a.pinBlocked {
+		return ErrPINBlocked
+	}
+	// Unlike in a prompt, a wrong PIN here can't be typed again, so don't spend
+	// one of the retries that -min-pin-retries keeps.
+	if r := a.lastRetries(); r >= 0 && r <= a.MinPINRetries {
+		return fmt.Errorf("only %d PIN retries remaining, not trying a PIN that was not typed in a prompt", r)
+	}
+	err := a.yk.VerifyPIN(pin)
+	var authErr piv.AuthErr
+	if errors.As(err, &authErr) {
+		a.setRetries(authErr.Retries)
+		a.pinFailed = true
+		return fmt.Errorf("wrong PIN (%d retries remaining)", authErr.Retries)
+	}
+	if err != nil {
+		return err
+	}
+	a.retriesKnown, a.pinFailed = false, false
+
+	a.unlockedPINs.Set(a.serial, pin)
+	if a.pinExpiry != nil {
+		a.pinExpiry.Stop()
+		a.pinExpiry = nil
+	}
+	if lifetime > 0 {
+		serial := a.serial
+		var t *time.Timer
+		t = time.AfterFunc(lifetime, func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			// Another "ssh-add -s" might have replaced this timer while it
+			// waited for the lock, and then the PIN is not this one's.
+			if a.pinExpiry != t {
+				return
+			}
+			a.pinExpiry = nil
+			a.unlockedPINs.Delete(serial)
+			a.logInfo("PIN forgotten, its ssh-add lifetime expired", "event", "pin-forgotten", "serial", serial)
+		})
+		a.pinExpiry = t
+		a.logInfo("PIN verified and remembered", "event", "pin-verified", "serial", a.serial, "lifetime", lifetime)
+	} else {
+		a.logInfo("PIN verified and remembered", "event", "pin-verified", "serial", a.serial)
+	}
+
+	return nil
+}
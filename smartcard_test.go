@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+func TestUnlockPINLifetime(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	a := newTestAgent(t, d, &pinPrompter{})
+	if err := a.unlockPIN(fakePIN, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// Let the first lifetime end while the lock is held, so that its timer
+	// fires and waits, and then replace the PIN with one without a lifetime.
+	a.mu.Lock()
+	time.Sleep(100 * time.Millisecond)
+	a.mu.Unlock()
+	if err := a.unlockPIN(fakePIN, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := a.unlockedPINs.Get(42); !ok {
+		t.Fatal("the PIN was forgotten by the lifetime of the previous ssh-add -s")
+	}
+
+	if err := a.unlockPIN(fakePIN, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := a.unlockedPINs.Get(42); ok {
+		t.Fatal("the PIN outlived its ssh-add lifetime")
+	}
+}
+
+func TestUnlockPINNotPersisted(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	p := &pinPrompter{}
+	a := newTestAgent(t, d, p)
+	// Like -save-pin, a cache that outlives the agent.
+	cache := &testPINCache{pins: make(map[uint32]string)}
+	a.PINCache = cache
+	if err := a.unlockPIN(fakePIN, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cache.sets != 0 {
+		t.Fatal("the PIN from ssh-add -s was stored in PINCache")
+	}
+	if a.PINCache != cache {
+		t.Fatal("unlockPIN replaced PINCache")
+	}
+
+	// A new session needs the PIN again, which must come from memory.
+	d.breakSession()
+	key := d.publicKey(t, piv.SlotAuthentication)
+	if _, err := a.Sign(key, []byte("session")); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.reqs) != 0 {
+		t.Errorf("got %d PIN prompts, want none", len(p.reqs))
+	}
+	if cache.sets != 0 {
+		t.Fatal("the PIN from ssh-add -s was stored in PINCache after use")
+	}
+
+	a.forgetPIN()
+	if _, ok := a.unlockedPINs.Get(42); ok {
+		t.Fatal("forgetPIN left the PIN from ssh-add -s in memory")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultSocketPath returns the socket to listen on if no -l flag is passed.
+// That's in XDG_RUNTIME_DIR if set, which is private to the user, and on macOS
+// in the per-user temporary directory otherwise. It returns "" if there is no
+// suitable location.
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "yubikey-agent", "yubikey-agent.sock")
+	}
+	if runtime.GOOS == "darwin" {
+		// On macOS, TMPDIR is a per-user directory under /var/folders.
+		if dir := os.Getenv("TMPDIR"); dir != "" {
+			return filepath.Join(dir, "yubikey-agent", "yubikey-agent.sock")
+		}
+	}
+	return ""
+}
+
+// listenSocket listens on the UNIX socket at path, which is created with the
+// given permissions. The umask is set while creating it, so that it's never
+// reachable with wider permissions, even briefly.
+func listenSocket(path string, mode os.FileMode) (net.Listener, error) {
+	old := unix.Umask(int(0777 &^ mode.Perm()))
+	l, err := net.Listen("unix", path)
+	unix.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(path, "@") {
+		if err := os.Chmod(path, mode.Perm()); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// listenPipe fails, as named pipes only exist on Windows.
+func listenPipe(path string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
+
+// listenCygwin fails, as Cygwin sockets only exist on Windows.
+func listenCygwin(path string) (net.Listener, error) {
+	return nil, errors.New("Cygwin sockets are only supported on Windows")
+}
+
+// checkSocketDir returns an error if dir is owned by another user, who could
+// replace the socket, or change the permissions of the directory.
+func checkSocketDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if uid := os.Getuid(); int(st.Uid) != uid {
+		return fmt.Errorf("%s is owned by uid %d, not by the current user (uid %d)", dir, st.Uid, uid)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+)
+
+// defaultSocketPath returns where Win32-OpenSSH looks for the agent, used if
+// no -l flag is passed.
+func defaultSocketPath() string {
+	return `\\.\pipe\openssh-ssh-agent`
+}
+
+// listenSocket listens on the UNIX socket at path. Windows ignores mode, and
+// the socket is protected by the permissions of its directory.
+func listenSocket(path string, mode os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+// listenPipe listens on the named pipe at path, which only the current user
+// can connect to.
+func listenPipe(path string) (net.Listener, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the current user: %w", err)
+	}
+	l, err := winio.ListenPipe(path, &winio.PipeConfig{
+		SecurityDescriptor: "D:P(A;;GA;;;" + user.User.Sid.String() + ")",
+	})
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_PIPE_BUSY) {
+		return nil, fmt.Errorf("%w\n\nThe pipe is already in use, probably by the OpenSSH Authentication Agent service. "+
+			"To stop and disable it, run in an administrator PowerShell:\n\n"+
+			"    Stop-Service ssh-agent\n    Set-Service ssh-agent -StartupType Disabled", err)
+	}
+	return l, err
+}
+
+// checkSocketDir is a no-op on Windows, where directory ownership works
+// differently.
+func checkSocketDir(dir string) error {
+	return nil
+}
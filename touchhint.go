@@ -0,0 +1,63 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// touchHint signals that the YubiKey is waiting for a touch outside of
+// desktop notifications, for when the user is looking at a terminal on
+// another machine. If TouchTTY is set, it rings the bell and sends an OSC 777
+// notification to that terminal. If TouchHintFile is set, it writes "1" to it
+// until ctx is done, and then "0", for shell prompts to show.
+func (a *Agent) touchHint(ctx context.Context, req PINRequest) {
+	if a.TouchTTY != "" {
+		if err := ringTTY(a.TouchTTY, message("touchNotification", req)); err != nil {
+			slog.Error(fmt.Sprintf("Failed to write the touch hint to the terminal: %v", err), "error", err)
+		}
+	}
+	if a.TouchHintFile != "" {
+		writeTouchHintFile(a.TouchHintFile, true)
+		go func() {
+			<-ctx.Done()
+			writeTouchHintFile(a.TouchHintFile, false)
+		}()
+	}
+}
+
+// ringTTY writes a bell and an OSC 777 notification with message to the
+// terminal at path. Terminals that don't support OSC 777 ignore it.
+func ringTTY(path, message string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	message = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == ';' {
+			return ' '
+		}
+		return r
+	}, message)
+	_, err = fmt.Fprintf(f, "\a\x1b]777;notify;yubikey-agent;%s\x1b\\", message)
+	return err
+}
+
+func writeTouchHintFile(path string, waiting bool) {
+	content := "0"
+	if waiting {
+		content = "1"
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		slog.Error(fmt.Sprintf("Failed to write the touch hint file: %v", err), "error", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// loopCheckExtension is sent to the upstream agent to find out if it leads
+// back to this agent. Its contents are the loopTokens of the agents the
+// request went through. Each yubikey-agent replies with success if its own
+// token is there, and otherwise adds its token and forwards the request to its
+// own upstream agent. Other agents don't know the extension and fail it.
+const loopCheckExtension = "loop-check@filippo.io"
+
+const loopTokenSize = 16
+
+// loopToken identifies this process in loop check requests.
+var loopToken = func() []byte {
+	b := make([]byte, loopTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// upstreamAgent returns the connection of c to the Upstream agent, dialing it
+// if necessary. It returns nil if there is no upstream agent, if it can't be
+// reached, or if it leads back to this agent.
+func (c *client) upstreamAgent() agent.ExtendedAgent {
+	if c.Upstream == "" || c.upstreamLoop.Load() {
+		return nil
+	}
+	if c.upstream != nil {
+		return c.upstream
+	}
+	conn, err := dialUpstream(c.Upstream)
+	if err != nil {
+		if !c.upstreamDown.Swap(true) {
+			slog.Warn("upstream agent unreachable, only offering YubiKey keys", "upstream", c.Upstream, "error", err)
+		}
+		return nil
+	}
+	if c.upstreamDown.Swap(false) {
+		slog.Info("upstream agent reachable again", "upstream", c.Upstream)
+	}
+	ua := agent.NewClient(conn)
+	if _, err := ua.Extension(loopCheckExtension, loopToken); err == nil {
+		conn.Close()
+		if !c.upstreamLoop.Swap(true) {
+			slog.Warn("upstream agent leads back to this agent, ignoring it", "upstream", c.Upstream)
+		}
+		return nil
+	}
+	c.upstream, c.upstreamConn = ua, conn
+	return ua
+}
+
+func dialUpstream(path string) (net.Conn, error) {
+	return net.DialTimeout("unix", path, time.Second)
+}
+
+// closeUpstream closes the connection to the Upstream agent, if any.
+func (c *client) closeUpstream() {
+	if c.upstreamConn != nil {
+		c.upstreamConn.Close()
+		c.upstream, c.upstreamConn = nil, nil
+	}
+}
+
+// loopCheck handles loopCheckExtension. It doesn't use upstreamAgent, which
+// would start a loop check of its own.
+func (c *client) loopCheck(tokens []byte) ([]byte, error) {
+	if len(tokens)%loopTokenSize != 0 {
+		return nil, errors.New("malformed loop check request")
+	}
+	for i := 0; i < len(tokens); i += loopTokenSize {
+		if bytes.Equal(tokens[i:i+loopTokenSize], loopToken) {
+			return nil, nil
+		}
+	}
+	if c.Upstream == "" || c.upstreamLoop.Load() {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	conn, err := dialUpstream(c.Upstream)
+	if err != nil {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	defer conn.Close()
+	tokens = append(tokens[:len(tokens):len(tokens)], loopToken...)
+	if _, err := agent.NewClient(conn).Extension(loopCheckExtension, tokens); err != nil {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return nil, nil
+}
+
+// List returns the keys on the YubiKey followed by those of the Upstream
+// agent. If only one of them can be reached, its keys are still returned.
+func (c *client) List() ([]*agent.Key, error) {
+	keys, err := c.Agent.list(c)
+	ua := c.upstreamAgent()
+	if ua == nil || c.slot != nil {
+		return keys, err
+	}
+	if err != nil {
+		c.logInfo("only offering upstream keys", "connection", c.id, "error", err)
+		keys = nil
+	}
+	upstreamKeys, upstreamErr := ua.List()
+	if upstreamErr != nil {
+		slog.Error("failed to list the upstream agent keys", "connection", c.id, "error", upstreamErr)
+		return keys, err
+	}
+	for _, k := range upstreamKeys {
+		if !hasKey(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func hasKey(keys []*agent.Key, key *agent.Key) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Blob, key.Blob) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWithFlags signs with the YubiKey if it holds key, and otherwise passes
+// the request on to the Upstream agent. The user is asked to confirm the
+// signature at most once, even if the YubiKey fails after they allowed it.
+func (c *client) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	c.confirmed = false
+	sig, err := c.Agent.signWithFlags(c, key, data, flags)
+	if errors.Is(err, ErrNotConfirmed) ||
+		!errors.Is(err, errNoMatchingKey) && !errors.Is(err, errNoYubiKey) && !errors.Is(err, piv.ErrNotFound) {
+		return sig, err
+	}
+	ua := c.upstreamAgent()
+	if ua == nil || c.slot != nil {
+		return sig, err
+	}
+	if c.policy.Restricted && !c.confirmed {
+		if err := c.Agent.confirmSignature(c, key, "confirmRestricted"); err != nil {
+			return nil, err
+		}
+	}
+	sig, upstreamErr := ua.SignWithFlags(key, data, flags)
+	if upstreamErr != nil {
+		return nil, fmt.Errorf("%v, and the upstream agent failed: %w", err, upstreamErr)
+	}
+	c.logInfo("signed by the upstream agent",
+		"event", "signature", "connection", c.id, "fingerprint", ssh.FingerprintSHA256(key))
+
+	return sig, nil
+}
+
+// Add adds key to the Upstream agent, as the YubiKey can't hold software keys.
+func (c *client) Add(key agent.AddedKey) error {
+	if c.policy.Restricted {
+		return errRestricted
+	}
+	ua := c.upstreamAgent()
+	if ua == nil {
+		return c.Agent.Add(key)
+	}
+	return ua.Add(key)
+}
+
+// Remove removes key from the Upstream agent. Keys on the YubiKey can't be
+// removed.
+func (c *client) Remove(key ssh.PublicKey) error {
+	if c.policy.Restricted {
+		return errRestricted
+	}
+	ua := c.upstreamAgent()
+	if ua == nil {
+		return c.Agent.Remove(key)
+	}
+	return ua.Remove(key)
+}
+
+// RemoveAll makes the agent forget the PIN, and removes all the keys from the
+// Upstream agent.
+func (c *client) RemoveAll() error {
+	if c.policy.Restricted {
+		return errRestricted
+	}
+	err := c.Agent.RemoveAll()
+	if ua := c.upstreamAgent(); ua != nil {
+		if upstreamErr := ua.RemoveAll(); upstreamErr != nil {
+			return fmt.Errorf("upstream agent: %w", upstreamErr)
+		}
+	}
+	return err
+}
+
+// Lock locks both the agent and the Upstream agent.
+func (c *client) Lock(passphrase []byte) error {
+	if c.policy.Restricted {
+		return errRestricted
+	}
+	if err := c.Agent.Lock(passphrase); err != nil {
+		return err
+	}
+	if ua := c.upstreamAgent(); ua != nil {
+		if err := ua.Lock(passphrase); err != nil {
+			return fmt.Errorf("upstream agent: %w", err)
+		}
+	}
+	return nil
+}
+
+// Unlock unlocks both the agent and the Upstream agent.
+func (c *client) Unlock(passphrase []byte) error {
+	if c.policy.Restricted {
+		return errRestricted
+	}
+	if err := c.Agent.Unlock(passphrase); err != nil {
+		return err
+	}
+	if ua := c.upstreamAgent(); ua != nil {
+		if err := ua.Unlock(passphrase); err != nil {
+			return fmt.Errorf("upstream agent: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveUpstream serves an in-memory agent holding a new Ed25519 key on a
+// socket, and returns its path and the key.
+func serveUpstream(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "upstream.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	pk, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, pk
+}
+
+func TestUpstreamConfirmOnce(t *testing.T) {
+	d := newFakeDevice(t, 42, map[piv.Slot]string{piv.SlotAuthentication: "p256"})
+	upstream, upstreamKey := serveUpstream(t)
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		allow   bool
+		wantErr error
+	}{
+		{name: "YubiKey allowed", key: d.publicKey(t, piv.SlotAuthentication), allow: true},
+		{name: "YubiKey denied", key: d.publicKey(t, piv.SlotAuthentication), wantErr: ErrNotConfirmed},
+		{name: "upstream allowed", key: upstreamKey, allow: true},
+		{name: "upstream denied", key: upstreamKey, wantErr: ErrNotConfirmed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgent(t, d, &pinPrompter{pins: []string{fakePIN}})
+			a.Upstream = upstream
+			var asked int
+			a.ConfirmPrompt = func(desc string, timeout time.Duration) (bool, error) {
+				asked++
+				return tt.allow, nil
+			}
+			c := &client{Agent: a, id: 1, policy: connPolicy{Restricted: true}}
+			defer c.closeUpstream()
+
+			sig, err := c.SignWithFlags(tt.key, []byte("session"), 0)
+			if asked != 1 {
+				t.Errorf("the user was asked %d times, want once", asked)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.key.Verify([]byte("session"), sig); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
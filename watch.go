@@ -0,0 +1,74 @@
+// Copyright 2020 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-piv/piv-go/v2/piv"
+)
+
+// watchInterval is how often the smart card readers are polled by watchYK.
+const watchInterval = 2 * time.Second
+
+// watchYK polls the smart card readers, and connects to the YubiKey as soon as
+// one is inserted, so that the first request doesn't have to wait for it, and
+// drops the connection as soon as one is removed. It never returns.
+func (a *Agent) watchYK() {
+	var last []string
+	for ; ; time.Sleep(watchInterval) {
+		cards, err := piv.Cards()
+		if err != nil {
+			continue
+		}
+		added, removed := diffCards(last, cards)
+		last = cards
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		a.mu.Lock()
+		if len(removed) > 0 {
+			slog.Info("smart card removed", "readers", strings.Join(removed, ", "))
+			a.closeYK()
+		}
+		if len(added) > 0 {
+			slog.Info("smart card inserted", "readers", strings.Join(added, ", "))
+			if err := a.ensureYK(); err != nil {
+				slog.Error("failed to connect to the inserted YubiKey", "error", err)
+			} else {
+				a.maybeReleaseYK()
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// diffCards returns the names in cards but not in last, and vice versa.
+func diffCards(last, cards []string) (added, removed []string) {
+	in := func(name string, names []string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range cards {
+		if !in(name, last) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range last {
+		if !in(name, cards) {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}